@@ -20,13 +20,15 @@ func main() {
 
 	shared.InitLogger(*cfg)
 
-	wss, err := shared.NewWebSocketConnection(cfg)
+	wsc, err := shared.NewWebSocketConnection(cfg)
 	if err != nil {
-		log.Fatalf("Error creating WebSocket server: %v", err)
+		log.Fatalf("Error creating WebSocket connection: %v", err)
 	}
 
-	defer wss.Close()
+	defer wsc.Close()
 
-	httpServer := shared.NewHTTPServer(cfg, wss.Client)
-	log.Fatal(httpServer.Start())
+	httpServer := shared.NewHTTPServer(cfg, wsc)
+	if err := httpServer.Serve(); err != nil {
+		log.Fatal(err)
+	}
 }
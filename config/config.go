@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"strings"
 
@@ -10,22 +12,65 @@ import (
 )
 
 type Config struct {
-	X_Forwarded_Host     string
-	X_Forwarded_Proto    string
-	PORT                 string
-	SSL_CERT_FILE        string
-	SSL_KEY_FILE         string
-	REQUEST_CA_FILE      string
-	INSECURE_SKIP_VERIFY bool
-	LOG_LEVEL            string
-	LOG_JSON             bool
-	LOG_FILE             string
-	Type                 string
-	SERVER_URL           string
-	SOCKET_URL           string
-	SECRET               string
-	PROXY_TYPE           string
-	WHITE_LIST           []string
+	X_Forwarded_Host           string
+	X_Forwarded_Proto          string
+	PORT                       string
+	SSL_CERT_FILE              string
+	SSL_KEY_FILE               string
+	REQUEST_CA_FILE            string
+	REQUEST_CERT_FILE          string
+	REQUEST_KEY_FILE           string
+	REQUEST_TLS_MIN_VERSION    string
+	REQUEST_TLS_CIPHERS        []string
+	UPSTREAM_TLS_FILE          string
+	CLIENT_CA_FILE             string
+	TLS_CERT_FILE              string
+	TLS_KEY_FILE               string
+	SOCKET_CA_FILE             string
+	INSECURE_SKIP_VERIFY       bool
+	LOG_LEVEL                  string
+	LOG_JSON                   bool
+	LOG_FILE                   string
+	Type                       string
+	SERVER_URL                 string
+	SOCKET_URL                 string
+	SECRET                     string
+	PROXY_TYPE                 string
+	WHITE_LIST                 []string
+	DENY_LIST                  []string
+	ALLOW_PRIVATE_NETWORKS     bool
+	ALLOWED_NETWORKS           []string
+	BLOCKED_NETWORKS           []string
+	REQUEST_TIMEOUT            time.Duration
+	CLIENT_NAME                string
+	RECONNECT_MIN_DELAY        time.Duration
+	RECONNECT_MAX_DELAY        time.Duration
+	CLIENT_KEYS                map[string]string
+	TCP_FORWARDS               []string
+	MAX_CONCURRENT             int
+	STREAM_WINDOW              int
+	PUBLISH                    map[string]string
+	PUBLIC_DOMAIN              string
+	UPSTREAM_MAX_CONNS         int
+	UPSTREAM_IDLE_TIMEOUT      time.Duration
+	UPSTREAM_DISABLE_KEEPALIVE bool
+	RETRY_ATTEMPTS             int
+	RETRY_STATUS               []string
+	RETRY_BASE_DELAY           time.Duration
+	RETRY_MAX_DELAY            time.Duration
+	RETRY_BUDGET               int
+	ROUTE_TIMEOUTS             map[string]string
+	OTLP_ENDPOINT              string
+	OTLP_HEADERS               map[string]string
+	OTEL_SERVICE_NAME          string
+	COMPRESSION                []string
+	COMPRESSION_MIN_SIZE       int
+	FRAMING                    []string
+	HEARTBEAT_INTERVAL         time.Duration
+	HEARTBEAT_MISSES           int
+	SHUTDOWN_TIMEOUT           time.Duration
+	UPSTREAM_MAX_BUFFER_SIZE   int
+	MAX_QUEUED                 int
 }
 
 func filterEmpty(slice []string) []string {
@@ -38,24 +83,129 @@ func filterEmpty(slice []string) []string {
 	return result
 }
 
+// parseKeyValues parses "name=value,name2=value2" into a map.
+func parseKeyValues(value string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range filterEmpty(strings.Split(value, ",")) {
+		key, val, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			log.Printf("Invalid key=value pair %q", pair)
+			continue
+		}
+		result[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return result
+}
+
+func parseInt(value string) int {
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid number %q: %v", value, err)
+		return 0
+	}
+	return n
+}
+
+func parseDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q: %v", value, err)
+		return 0
+	}
+	return d
+}
+
+const redactedValue = "[REDACTED]"
+
+// redacted returns a copy of config with its credentials masked, for logging.
+func (config Config) redacted() Config {
+	if config.SECRET != "" {
+		config.SECRET = redactedValue
+	}
+	config.CLIENT_KEYS = redactValues(config.CLIENT_KEYS)
+	config.OTLP_HEADERS = redactValues(config.OTLP_HEADERS)
+	return config
+}
+
+func redactValues(values map[string]string) map[string]string {
+	if len(values) == 0 {
+		return values
+	}
+	result := make(map[string]string, len(values))
+	for key := range values {
+		result[key] = redactedValue
+	}
+	return result
+}
+
 func LoadConfig(userConfig *Config) (*Config, error) {
 	godotenv.Load()
 
 	envConfig := Config{
-		X_Forwarded_Host:     os.Getenv("X_FORWARDED_HOST"),
-		X_Forwarded_Proto:    os.Getenv("X_FORWARDED_PROTO"),
-		PORT:                 os.Getenv("PORT"),
-		SSL_CERT_FILE:        os.Getenv("SSL_CERT_FILE"),
-		WHITE_LIST:           filterEmpty(strings.Split(os.Getenv("WHITE_LIST"), ",")),
-		REQUEST_CA_FILE:      os.Getenv("REQUEST_CA_FILE"),
-		INSECURE_SKIP_VERIFY: os.Getenv("INSECURE_SKIP_VERIFY") == "true",
-		LOG_LEVEL:            os.Getenv("LOG_LEVEL"),
-		LOG_JSON:             os.Getenv("LOG_JSON") == "true",
-		LOG_FILE:             os.Getenv("LOG_FILE"),
-		Type:                 os.Getenv("TUNNEL_TYPE"),
-		SERVER_URL:           os.Getenv("SERVER_URL"),
-		SOCKET_URL:           os.Getenv("SOCKET_URL"),
-		SECRET:               os.Getenv("SECRET"),
+		X_Forwarded_Host:           os.Getenv("X_FORWARDED_HOST"),
+		X_Forwarded_Proto:          os.Getenv("X_FORWARDED_PROTO"),
+		PORT:                       os.Getenv("PORT"),
+		SSL_CERT_FILE:              os.Getenv("SSL_CERT_FILE"),
+		WHITE_LIST:                 filterEmpty(strings.Split(os.Getenv("WHITE_LIST"), ",")),
+		DENY_LIST:                  filterEmpty(strings.Split(os.Getenv("DENY_LIST"), ",")),
+		ALLOW_PRIVATE_NETWORKS:     os.Getenv("ALLOW_PRIVATE_NETWORKS") == "true",
+		ALLOWED_NETWORKS:           filterEmpty(strings.Split(os.Getenv("ALLOWED_NETWORKS"), ",")),
+		BLOCKED_NETWORKS:           filterEmpty(strings.Split(os.Getenv("BLOCKED_NETWORKS"), ",")),
+		REQUEST_CA_FILE:            os.Getenv("REQUEST_CA_FILE"),
+		REQUEST_CERT_FILE:          os.Getenv("REQUEST_CERT_FILE"),
+		REQUEST_KEY_FILE:           os.Getenv("REQUEST_KEY_FILE"),
+		REQUEST_TLS_MIN_VERSION:    os.Getenv("REQUEST_TLS_MIN_VERSION"),
+		REQUEST_TLS_CIPHERS:        filterEmpty(strings.Split(os.Getenv("REQUEST_TLS_CIPHERS"), ",")),
+		UPSTREAM_TLS_FILE:          os.Getenv("UPSTREAM_TLS_FILE"),
+		SSL_KEY_FILE:               os.Getenv("SSL_KEY_FILE"),
+		CLIENT_CA_FILE:             os.Getenv("CLIENT_CA_FILE"),
+		TLS_CERT_FILE:              os.Getenv("TLS_CERT_FILE"),
+		TLS_KEY_FILE:               os.Getenv("TLS_KEY_FILE"),
+		SOCKET_CA_FILE:             os.Getenv("SOCKET_CA_FILE"),
+		INSECURE_SKIP_VERIFY:       os.Getenv("INSECURE_SKIP_VERIFY") == "true",
+		LOG_LEVEL:                  os.Getenv("LOG_LEVEL"),
+		LOG_JSON:                   os.Getenv("LOG_JSON") == "true",
+		LOG_FILE:                   os.Getenv("LOG_FILE"),
+		Type:                       os.Getenv("TUNNEL_TYPE"),
+		SERVER_URL:                 os.Getenv("SERVER_URL"),
+		SOCKET_URL:                 os.Getenv("SOCKET_URL"),
+		SECRET:                     os.Getenv("SECRET"),
+		REQUEST_TIMEOUT:            parseDuration(os.Getenv("REQUEST_TIMEOUT")),
+		CLIENT_NAME:                os.Getenv("CLIENT_NAME"),
+		RECONNECT_MIN_DELAY:        parseDuration(os.Getenv("RECONNECT_MIN_DELAY")),
+		RECONNECT_MAX_DELAY:        parseDuration(os.Getenv("RECONNECT_MAX_DELAY")),
+		CLIENT_KEYS:                parseKeyValues(os.Getenv("CLIENT_KEYS")),
+		TCP_FORWARDS:               filterEmpty(strings.Split(os.Getenv("TCP_FORWARDS"), ",")),
+		MAX_CONCURRENT:             parseInt(os.Getenv("MAX_CONCURRENT")),
+		STREAM_WINDOW:              parseInt(os.Getenv("STREAM_WINDOW")),
+		PUBLISH:                    parseKeyValues(os.Getenv("PUBLISH")),
+		PUBLIC_DOMAIN:              os.Getenv("PUBLIC_DOMAIN"),
+		UPSTREAM_MAX_CONNS:         parseInt(os.Getenv("UPSTREAM_MAX_CONNS")),
+		UPSTREAM_IDLE_TIMEOUT:      parseDuration(os.Getenv("UPSTREAM_IDLE_TIMEOUT")),
+		UPSTREAM_DISABLE_KEEPALIVE: os.Getenv("UPSTREAM_DISABLE_KEEPALIVE") == "true",
+		RETRY_ATTEMPTS:             parseInt(os.Getenv("RETRY_ATTEMPTS")),
+		RETRY_STATUS:               filterEmpty(strings.Split(os.Getenv("RETRY_STATUS"), ",")),
+		RETRY_BASE_DELAY:           parseDuration(os.Getenv("RETRY_BASE_DELAY")),
+		RETRY_MAX_DELAY:            parseDuration(os.Getenv("RETRY_MAX_DELAY")),
+		RETRY_BUDGET:               parseInt(os.Getenv("RETRY_BUDGET")),
+		ROUTE_TIMEOUTS:             parseKeyValues(os.Getenv("ROUTE_TIMEOUTS")),
+		OTLP_ENDPOINT:              os.Getenv("OTLP_ENDPOINT"),
+		OTLP_HEADERS:               parseKeyValues(os.Getenv("OTLP_HEADERS")),
+		OTEL_SERVICE_NAME:          os.Getenv("OTEL_SERVICE_NAME"),
+		COMPRESSION:                filterEmpty(strings.Split(os.Getenv("COMPRESSION"), ",")),
+		COMPRESSION_MIN_SIZE:       parseInt(os.Getenv("COMPRESSION_MIN_SIZE")),
+		FRAMING:                    filterEmpty(strings.Split(os.Getenv("FRAMING"), ",")),
+		HEARTBEAT_INTERVAL:         parseDuration(os.Getenv("HEARTBEAT_INTERVAL")),
+		HEARTBEAT_MISSES:           parseInt(os.Getenv("HEARTBEAT_MISSES")),
+		SHUTDOWN_TIMEOUT:           parseDuration(os.Getenv("SHUTDOWN_TIMEOUT")),
+		UPSTREAM_MAX_BUFFER_SIZE:   parseInt(os.Getenv("UPSTREAM_MAX_BUFFER_SIZE")),
+		MAX_QUEUED:                 parseInt(os.Getenv("MAX_QUEUED")),
 	}
 
 	mergeConfig := func(envValue, userValue string) string {
@@ -66,22 +216,65 @@ func LoadConfig(userConfig *Config) (*Config, error) {
 	}
 
 	config := &Config{
-		X_Forwarded_Host:     envConfig.X_Forwarded_Host,
-		X_Forwarded_Proto:    envConfig.X_Forwarded_Proto,
-		PORT:                 envConfig.PORT,
-		SSL_CERT_FILE:        envConfig.SSL_CERT_FILE,
-		SSL_KEY_FILE:         envConfig.SSL_KEY_FILE,
-		REQUEST_CA_FILE:      envConfig.REQUEST_CA_FILE,
-		INSECURE_SKIP_VERIFY: envConfig.INSECURE_SKIP_VERIFY,
-		LOG_LEVEL:            envConfig.LOG_LEVEL,
-		LOG_JSON:             envConfig.LOG_JSON,
-		LOG_FILE:             envConfig.LOG_FILE,
-		Type:                 envConfig.Type,
-		SERVER_URL:           envConfig.SERVER_URL,
-		SOCKET_URL:           envConfig.SOCKET_URL,
-		SECRET:               envConfig.SECRET,
-		PROXY_TYPE:           envConfig.PROXY_TYPE,
-		WHITE_LIST:           envConfig.WHITE_LIST,
+		X_Forwarded_Host:           envConfig.X_Forwarded_Host,
+		X_Forwarded_Proto:          envConfig.X_Forwarded_Proto,
+		PORT:                       envConfig.PORT,
+		SSL_CERT_FILE:              envConfig.SSL_CERT_FILE,
+		SSL_KEY_FILE:               envConfig.SSL_KEY_FILE,
+		REQUEST_CA_FILE:            envConfig.REQUEST_CA_FILE,
+		REQUEST_CERT_FILE:          envConfig.REQUEST_CERT_FILE,
+		REQUEST_KEY_FILE:           envConfig.REQUEST_KEY_FILE,
+		REQUEST_TLS_MIN_VERSION:    envConfig.REQUEST_TLS_MIN_VERSION,
+		REQUEST_TLS_CIPHERS:        envConfig.REQUEST_TLS_CIPHERS,
+		UPSTREAM_TLS_FILE:          envConfig.UPSTREAM_TLS_FILE,
+		CLIENT_CA_FILE:             envConfig.CLIENT_CA_FILE,
+		TLS_CERT_FILE:              envConfig.TLS_CERT_FILE,
+		TLS_KEY_FILE:               envConfig.TLS_KEY_FILE,
+		SOCKET_CA_FILE:             envConfig.SOCKET_CA_FILE,
+		INSECURE_SKIP_VERIFY:       envConfig.INSECURE_SKIP_VERIFY,
+		LOG_LEVEL:                  envConfig.LOG_LEVEL,
+		LOG_JSON:                   envConfig.LOG_JSON,
+		LOG_FILE:                   envConfig.LOG_FILE,
+		Type:                       envConfig.Type,
+		SERVER_URL:                 envConfig.SERVER_URL,
+		SOCKET_URL:                 envConfig.SOCKET_URL,
+		SECRET:                     envConfig.SECRET,
+		PROXY_TYPE:                 envConfig.PROXY_TYPE,
+		WHITE_LIST:                 envConfig.WHITE_LIST,
+		DENY_LIST:                  envConfig.DENY_LIST,
+		ALLOW_PRIVATE_NETWORKS:     envConfig.ALLOW_PRIVATE_NETWORKS,
+		ALLOWED_NETWORKS:           envConfig.ALLOWED_NETWORKS,
+		BLOCKED_NETWORKS:           envConfig.BLOCKED_NETWORKS,
+		REQUEST_TIMEOUT:            envConfig.REQUEST_TIMEOUT,
+		CLIENT_NAME:                envConfig.CLIENT_NAME,
+		RECONNECT_MIN_DELAY:        envConfig.RECONNECT_MIN_DELAY,
+		RECONNECT_MAX_DELAY:        envConfig.RECONNECT_MAX_DELAY,
+		CLIENT_KEYS:                envConfig.CLIENT_KEYS,
+		TCP_FORWARDS:               envConfig.TCP_FORWARDS,
+		MAX_CONCURRENT:             envConfig.MAX_CONCURRENT,
+		STREAM_WINDOW:              envConfig.STREAM_WINDOW,
+		PUBLISH:                    envConfig.PUBLISH,
+		PUBLIC_DOMAIN:              envConfig.PUBLIC_DOMAIN,
+		UPSTREAM_MAX_CONNS:         envConfig.UPSTREAM_MAX_CONNS,
+		UPSTREAM_IDLE_TIMEOUT:      envConfig.UPSTREAM_IDLE_TIMEOUT,
+		UPSTREAM_DISABLE_KEEPALIVE: envConfig.UPSTREAM_DISABLE_KEEPALIVE,
+		RETRY_ATTEMPTS:             envConfig.RETRY_ATTEMPTS,
+		RETRY_STATUS:               envConfig.RETRY_STATUS,
+		RETRY_BASE_DELAY:           envConfig.RETRY_BASE_DELAY,
+		RETRY_MAX_DELAY:            envConfig.RETRY_MAX_DELAY,
+		RETRY_BUDGET:               envConfig.RETRY_BUDGET,
+		ROUTE_TIMEOUTS:             envConfig.ROUTE_TIMEOUTS,
+		OTLP_ENDPOINT:              envConfig.OTLP_ENDPOINT,
+		OTLP_HEADERS:               envConfig.OTLP_HEADERS,
+		OTEL_SERVICE_NAME:          envConfig.OTEL_SERVICE_NAME,
+		COMPRESSION:                envConfig.COMPRESSION,
+		COMPRESSION_MIN_SIZE:       envConfig.COMPRESSION_MIN_SIZE,
+		FRAMING:                    envConfig.FRAMING,
+		HEARTBEAT_INTERVAL:         envConfig.HEARTBEAT_INTERVAL,
+		HEARTBEAT_MISSES:           envConfig.HEARTBEAT_MISSES,
+		SHUTDOWN_TIMEOUT:           envConfig.SHUTDOWN_TIMEOUT,
+		UPSTREAM_MAX_BUFFER_SIZE:   envConfig.UPSTREAM_MAX_BUFFER_SIZE,
+		MAX_QUEUED:                 envConfig.MAX_QUEUED,
 	}
 
 	if userConfig != nil {
@@ -91,6 +284,17 @@ func LoadConfig(userConfig *Config) (*Config, error) {
 		config.SSL_CERT_FILE = mergeConfig(envConfig.SSL_CERT_FILE, userConfig.SSL_CERT_FILE)
 		config.SSL_KEY_FILE = mergeConfig(envConfig.SSL_KEY_FILE, userConfig.SSL_KEY_FILE)
 		config.REQUEST_CA_FILE = mergeConfig(envConfig.REQUEST_CA_FILE, userConfig.REQUEST_CA_FILE)
+		config.REQUEST_CERT_FILE = mergeConfig(envConfig.REQUEST_CERT_FILE, userConfig.REQUEST_CERT_FILE)
+		config.REQUEST_KEY_FILE = mergeConfig(envConfig.REQUEST_KEY_FILE, userConfig.REQUEST_KEY_FILE)
+		config.REQUEST_TLS_MIN_VERSION = mergeConfig(envConfig.REQUEST_TLS_MIN_VERSION, userConfig.REQUEST_TLS_MIN_VERSION)
+		if len(userConfig.REQUEST_TLS_CIPHERS) > 0 {
+			config.REQUEST_TLS_CIPHERS = userConfig.REQUEST_TLS_CIPHERS
+		}
+		config.UPSTREAM_TLS_FILE = mergeConfig(envConfig.UPSTREAM_TLS_FILE, userConfig.UPSTREAM_TLS_FILE)
+		config.CLIENT_CA_FILE = mergeConfig(envConfig.CLIENT_CA_FILE, userConfig.CLIENT_CA_FILE)
+		config.TLS_CERT_FILE = mergeConfig(envConfig.TLS_CERT_FILE, userConfig.TLS_CERT_FILE)
+		config.TLS_KEY_FILE = mergeConfig(envConfig.TLS_KEY_FILE, userConfig.TLS_KEY_FILE)
+		config.SOCKET_CA_FILE = mergeConfig(envConfig.SOCKET_CA_FILE, userConfig.SOCKET_CA_FILE)
 		config.INSECURE_SKIP_VERIFY = userConfig.INSECURE_SKIP_VERIFY || envConfig.INSECURE_SKIP_VERIFY
 		config.LOG_LEVEL = mergeConfig(envConfig.LOG_LEVEL, userConfig.LOG_LEVEL)
 		config.LOG_JSON = userConfig.LOG_JSON || envConfig.LOG_JSON
@@ -100,11 +304,101 @@ func LoadConfig(userConfig *Config) (*Config, error) {
 		config.SOCKET_URL = mergeConfig(envConfig.SOCKET_URL, userConfig.SOCKET_URL)
 		config.SECRET = mergeConfig(envConfig.SECRET, userConfig.SECRET)
 		config.PROXY_TYPE = mergeConfig(envConfig.PROXY_TYPE, userConfig.PROXY_TYPE)
+		config.CLIENT_NAME = mergeConfig(envConfig.CLIENT_NAME, userConfig.CLIENT_NAME)
 		if len(userConfig.WHITE_LIST) > 0 {
 			config.WHITE_LIST = userConfig.WHITE_LIST
 		} else {
 			config.WHITE_LIST = envConfig.WHITE_LIST
 		}
+		if len(userConfig.DENY_LIST) > 0 {
+			config.DENY_LIST = userConfig.DENY_LIST
+		}
+		config.ALLOW_PRIVATE_NETWORKS = userConfig.ALLOW_PRIVATE_NETWORKS || envConfig.ALLOW_PRIVATE_NETWORKS
+		if len(userConfig.ALLOWED_NETWORKS) > 0 {
+			config.ALLOWED_NETWORKS = userConfig.ALLOWED_NETWORKS
+		}
+		if len(userConfig.BLOCKED_NETWORKS) > 0 {
+			config.BLOCKED_NETWORKS = userConfig.BLOCKED_NETWORKS
+		}
+		config.PUBLIC_DOMAIN = mergeConfig(envConfig.PUBLIC_DOMAIN, userConfig.PUBLIC_DOMAIN)
+		if len(userConfig.PUBLISH) > 0 {
+			config.PUBLISH = userConfig.PUBLISH
+		}
+		if userConfig.MAX_CONCURRENT > 0 {
+			config.MAX_CONCURRENT = userConfig.MAX_CONCURRENT
+		}
+		if userConfig.STREAM_WINDOW > 0 {
+			config.STREAM_WINDOW = userConfig.STREAM_WINDOW
+		}
+		if len(userConfig.TCP_FORWARDS) > 0 {
+			config.TCP_FORWARDS = userConfig.TCP_FORWARDS
+		}
+		if len(userConfig.CLIENT_KEYS) > 0 {
+			config.CLIENT_KEYS = userConfig.CLIENT_KEYS
+		}
+		if userConfig.REQUEST_TIMEOUT > 0 {
+			config.REQUEST_TIMEOUT = userConfig.REQUEST_TIMEOUT
+		}
+		if userConfig.RECONNECT_MIN_DELAY > 0 {
+			config.RECONNECT_MIN_DELAY = userConfig.RECONNECT_MIN_DELAY
+		}
+		if userConfig.RECONNECT_MAX_DELAY > 0 {
+			config.RECONNECT_MAX_DELAY = userConfig.RECONNECT_MAX_DELAY
+		}
+		if userConfig.UPSTREAM_MAX_CONNS > 0 {
+			config.UPSTREAM_MAX_CONNS = userConfig.UPSTREAM_MAX_CONNS
+		}
+		if userConfig.UPSTREAM_IDLE_TIMEOUT > 0 {
+			config.UPSTREAM_IDLE_TIMEOUT = userConfig.UPSTREAM_IDLE_TIMEOUT
+		}
+		config.UPSTREAM_DISABLE_KEEPALIVE = userConfig.UPSTREAM_DISABLE_KEEPALIVE || envConfig.UPSTREAM_DISABLE_KEEPALIVE
+		if userConfig.RETRY_ATTEMPTS > 0 {
+			config.RETRY_ATTEMPTS = userConfig.RETRY_ATTEMPTS
+		}
+		if len(userConfig.RETRY_STATUS) > 0 {
+			config.RETRY_STATUS = userConfig.RETRY_STATUS
+		}
+		if userConfig.RETRY_BASE_DELAY > 0 {
+			config.RETRY_BASE_DELAY = userConfig.RETRY_BASE_DELAY
+		}
+		if userConfig.RETRY_MAX_DELAY > 0 {
+			config.RETRY_MAX_DELAY = userConfig.RETRY_MAX_DELAY
+		}
+		if userConfig.RETRY_BUDGET != 0 {
+			config.RETRY_BUDGET = userConfig.RETRY_BUDGET
+		}
+		if len(userConfig.ROUTE_TIMEOUTS) > 0 {
+			config.ROUTE_TIMEOUTS = userConfig.ROUTE_TIMEOUTS
+		}
+		config.OTLP_ENDPOINT = mergeConfig(envConfig.OTLP_ENDPOINT, userConfig.OTLP_ENDPOINT)
+		if len(userConfig.OTLP_HEADERS) > 0 {
+			config.OTLP_HEADERS = userConfig.OTLP_HEADERS
+		}
+		config.OTEL_SERVICE_NAME = mergeConfig(envConfig.OTEL_SERVICE_NAME, userConfig.OTEL_SERVICE_NAME)
+		if len(userConfig.COMPRESSION) > 0 {
+			config.COMPRESSION = userConfig.COMPRESSION
+		}
+		if userConfig.COMPRESSION_MIN_SIZE > 0 {
+			config.COMPRESSION_MIN_SIZE = userConfig.COMPRESSION_MIN_SIZE
+		}
+		if len(userConfig.FRAMING) > 0 {
+			config.FRAMING = userConfig.FRAMING
+		}
+		if userConfig.HEARTBEAT_INTERVAL > 0 {
+			config.HEARTBEAT_INTERVAL = userConfig.HEARTBEAT_INTERVAL
+		}
+		if userConfig.HEARTBEAT_MISSES > 0 {
+			config.HEARTBEAT_MISSES = userConfig.HEARTBEAT_MISSES
+		}
+		if userConfig.SHUTDOWN_TIMEOUT > 0 {
+			config.SHUTDOWN_TIMEOUT = userConfig.SHUTDOWN_TIMEOUT
+		}
+		if userConfig.UPSTREAM_MAX_BUFFER_SIZE > 0 {
+			config.UPSTREAM_MAX_BUFFER_SIZE = userConfig.UPSTREAM_MAX_BUFFER_SIZE
+		}
+		if userConfig.MAX_QUEUED > 0 {
+			config.MAX_QUEUED = userConfig.MAX_QUEUED
+		}
 	}
 
 	if config.PORT == "" {
@@ -119,11 +413,98 @@ func LoadConfig(userConfig *Config) (*Config, error) {
 		config.Type = "client"
 	}
 
+	if config.REQUEST_TIMEOUT <= 0 {
+		config.REQUEST_TIMEOUT = 60 * time.Second
+	}
+
+	if config.RECONNECT_MIN_DELAY <= 0 {
+		config.RECONNECT_MIN_DELAY = 1 * time.Second
+	}
+
+	if config.RECONNECT_MAX_DELAY <= 0 {
+		config.RECONNECT_MAX_DELAY = 30 * time.Second
+	}
+
+	if config.RECONNECT_MAX_DELAY < config.RECONNECT_MIN_DELAY {
+		config.RECONNECT_MAX_DELAY = config.RECONNECT_MIN_DELAY
+	}
+
+	if config.MAX_CONCURRENT <= 0 {
+		config.MAX_CONCURRENT = 100
+	}
+
+	if config.STREAM_WINDOW <= 0 {
+		config.STREAM_WINDOW = 16
+	}
+
+	if config.CLIENT_NAME == "" {
+		config.CLIENT_NAME = "default"
+	}
+
 	if config.PROXY_TYPE == "" {
 		config.PROXY_TYPE = "wss"
 	}
 
-	log.Println("Config loaded", config)
+	if config.UPSTREAM_MAX_CONNS <= 0 {
+		config.UPSTREAM_MAX_CONNS = 512
+	}
+
+	if config.UPSTREAM_IDLE_TIMEOUT <= 0 {
+		config.UPSTREAM_IDLE_TIMEOUT = 60 * time.Second
+	}
+
+	if config.RETRY_ATTEMPTS <= 0 {
+		config.RETRY_ATTEMPTS = 3
+	}
+
+	if len(config.RETRY_STATUS) == 0 {
+		config.RETRY_STATUS = []string{"502", "503", "504"}
+	}
+
+	if config.RETRY_BASE_DELAY <= 0 {
+		config.RETRY_BASE_DELAY = 100 * time.Millisecond
+	}
+
+	if config.RETRY_MAX_DELAY <= 0 {
+		config.RETRY_MAX_DELAY = 2 * time.Second
+	}
+
+	// 0 or less disables the retry budget, so only an unset one gets the default.
+	if os.Getenv("RETRY_BUDGET") == "" && config.RETRY_BUDGET == 0 {
+		config.RETRY_BUDGET = 20
+	}
+
+	if len(config.COMPRESSION) == 0 {
+		config.COMPRESSION = []string{"zstd", "gzip"}
+	}
+	if config.COMPRESSION_MIN_SIZE <= 0 {
+		config.COMPRESSION_MIN_SIZE = 1024
+	}
+	if len(config.FRAMING) == 0 {
+		config.FRAMING = []string{"binary", "json"}
+	}
+
+	if config.HEARTBEAT_INTERVAL <= 0 {
+		config.HEARTBEAT_INTERVAL = 15 * time.Second
+	}
+
+	if config.HEARTBEAT_MISSES <= 0 {
+		config.HEARTBEAT_MISSES = 3
+	}
+
+	if config.SHUTDOWN_TIMEOUT <= 0 {
+		config.SHUTDOWN_TIMEOUT = 30 * time.Second
+	}
+
+	if config.UPSTREAM_MAX_BUFFER_SIZE <= 0 {
+		config.UPSTREAM_MAX_BUFFER_SIZE = 8 << 20
+	}
+
+	if config.MAX_QUEUED <= 0 {
+		config.MAX_QUEUED = 1000
+	}
+
+	log.Println("Config loaded", config.redacted())
 
 	if config.SOCKET_URL == "" && config.Type == "client" {
 		panic("SOCKET_URL is mandatory for client")
@@ -22,5 +22,7 @@ func main() {
 
 	shared.NewWebSocketServer(httpServer)
 
-	log.Fatal(httpServer.Start())
+	if err := httpServer.Serve(); err != nil {
+		log.Fatal(err)
+	}
 }
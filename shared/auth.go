@@ -0,0 +1,118 @@
+package shared
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/niradler/go-netbridge/tunnel"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUnknownClient      = errors.New("unknown client")
+	ErrInvalidClientName  = errors.New("invalid client name")
+	ErrMissingCertificate = errors.New("missing client certificate")
+	ErrIdentityMismatch   = errors.New("client name does not match certificate")
+)
+
+// handshakeToken extracts the token a tunnel client presented on the /_ws
+// handshake. Clients send "Authorization: Bearer <token>"; a bare token and
+// the X-Auth-SECRET header are accepted from older clients.
+func handshakeToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, found := strings.Cut(auth, " "); found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return auth
+	}
+	return r.Header.Get("X-Auth-SECRET")
+}
+
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// certificateIdentity returns the client name from a verified client
+// certificate: its subject common name, or else its first DNS name.
+func certificateIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, true
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], true
+	}
+	return "", false
+}
+
+// AuthenticateHandshake checks the credentials of a tunnel client connecting
+// to /_ws and returns its name. With CLIENT_CA_FILE set the client must
+// present a verified certificate, which alone authenticates it and names it.
+// Otherwise a client listed in CLIENT_KEYS must present its own key and any
+// other client must present SECRET. When nothing is configured the handshake
+// is open.
+func AuthenticateHandshake(r *http.Request, cfg *config.Config) (string, error) {
+	if cfg.CLIENT_CA_FILE != "" {
+		identity, ok := certificateIdentity(r)
+		if !ok {
+			return r.Header.Get(tunnel.ClientNameHeader), ErrMissingCertificate
+		}
+		if name := r.Header.Get(tunnel.ClientNameHeader); name != "" && name != identity {
+			return name, ErrIdentityMismatch
+		}
+		if !ValidClientName(identity) {
+			return identity, ErrInvalidClientName
+		}
+		return identity, nil
+	}
+
+	name := r.Header.Get(tunnel.ClientNameHeader)
+	if name == "" {
+		name = DefaultClientName
+	}
+	if !ValidClientName(name) {
+		return name, ErrInvalidClientName
+	}
+
+	if len(cfg.CLIENT_KEYS) == 0 && cfg.SECRET == "" {
+		return name, nil
+	}
+
+	token := handshakeToken(r)
+	if token == "" {
+		return name, ErrMissingCredentials
+	}
+
+	if key, ok := cfg.CLIENT_KEYS[name]; ok {
+		if !tokenEqual(token, key) {
+			return name, ErrInvalidCredentials
+		}
+		return name, nil
+	}
+
+	if cfg.SECRET == "" {
+		return name, ErrUnknownClient
+	}
+	if !tokenEqual(token, cfg.SECRET) {
+		return name, ErrInvalidCredentials
+	}
+	return name, nil
+}
+
+// handshakeStatus maps a handshake error to the HTTP status it is rejected with.
+func handshakeStatus(err error) int {
+	switch err {
+	case ErrInvalidClientName:
+		return http.StatusBadRequest
+	case ErrUnknownClient, ErrIdentityMismatch:
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
@@ -0,0 +1,105 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrRequestCancelled = errors.New("request cancelled")
+
+// CancelMessage tells the peer the caller of a request has given up before
+// its response arrived. Once the response is streaming, resetting the stream
+// does the same.
+type CancelMessage struct {
+	ID string `json:"id"`
+}
+
+// sendCancel asks the peer to stop working on the request with the given ID.
+func (wss *WebSocketServer) sendCancel(id string) {
+	payload, err := json.Marshal(CancelMessage{ID: id})
+	if err != nil {
+		return
+	}
+	if _, err := sendMessage(wss.conn, "cancel", payload); err != nil {
+		GetLogger().Debug("Failed to send cancel", zap.String("requestID", id), zap.String("error", err.Error()))
+	}
+}
+
+// earlyCancelTTL is how long a cancel for a request not seen yet is kept.
+// Requests and cancels are read on separate goroutines, so a cancel sent right
+// after its request may be handled first.
+const earlyCancelTTL = 10 * time.Second
+
+// track registers a request received from the peer so it can be cancelled,
+// and returns the function to call once it is done.
+func (wss *WebSocketServer) track(req *HttpRequestMessage) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	req.cancel = ctx.Done()
+	wss.cancelMu.Lock()
+	if _, ok := wss.earlyCancels[req.ID]; ok {
+		delete(wss.earlyCancels, req.ID)
+		GetLogger().Debug("Request cancelled by peer before it was handled", zap.String("requestID", req.ID))
+		cancel()
+	}
+	wss.inflight.Store(req.ID, cancel)
+	wss.cancelMu.Unlock()
+	return func() {
+		wss.inflight.Delete(req.ID)
+		cancel()
+	}
+}
+
+func (wss *WebSocketServer) handleCancel(msg *CancelMessage) {
+	wss.cancelMu.Lock()
+	defer wss.cancelMu.Unlock()
+	if cancel, ok := wss.inflight.Load(msg.ID); ok {
+		GetLogger().Debug("Request cancelled by peer", zap.String("requestID", msg.ID))
+		cancel.(context.CancelFunc)()
+		return
+	}
+	now := time.Now()
+	for id, at := range wss.earlyCancels {
+		if now.Sub(at) > earlyCancelTTL {
+			delete(wss.earlyCancels, id)
+		}
+	}
+	if wss.earlyCancels == nil {
+		wss.earlyCancels = make(map[string]time.Time)
+	}
+	wss.earlyCancels[msg.ID] = now
+}
+
+// cancelled reports whether the caller of a request has given up.
+func (req *HttpRequestMessage) cancelled() bool {
+	select {
+	case <-req.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, returning early with ErrRequestCancelled when the caller
+// gives up or ErrRequestTimeout when the request runs out of time.
+func (req *HttpRequestMessage) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var deadline <-chan time.Time
+	if !req.deadline.IsZero() {
+		deadlineTimer := time.NewTimer(time.Until(req.deadline))
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.cancel:
+		return ErrRequestCancelled
+	case <-deadline:
+		return ErrRequestTimeout
+	}
+}
@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+func TestCancelBeforeRequest(t *testing.T) {
+	InitLogger(config.Config{})
+	wss := &WebSocketServer{}
+	wss.handleCancel(&CancelMessage{ID: "early"})
+
+	req := &HttpRequestMessage{ID: "early"}
+	done := wss.track(req)
+	defer done()
+	if !req.cancelled() {
+		t.Error("request whose cancel arrived first is not cancelled")
+	}
+
+	other := &HttpRequestMessage{ID: "other"}
+	defer wss.track(other)()
+	if other.cancelled() {
+		t.Error("request without a cancel is cancelled")
+	}
+
+	// The early cancel is used up by its request.
+	again := &HttpRequestMessage{ID: "early"}
+	defer wss.track(again)()
+	if again.cancelled() {
+		t.Error("early cancel applied twice")
+	}
+}
+
+func TestCancelBeforeRequestExpires(t *testing.T) {
+	InitLogger(config.Config{})
+	wss := &WebSocketServer{}
+	wss.handleCancel(&CancelMessage{ID: "stale"})
+	wss.earlyCancels["stale"] = time.Now().Add(-2 * earlyCancelTTL)
+	wss.handleCancel(&CancelMessage{ID: "fresh"})
+
+	req := &HttpRequestMessage{ID: "stale"}
+	defer wss.track(req)()
+	if req.cancelled() {
+		t.Error("request cancelled by an expired early cancel")
+	}
+	if len(wss.earlyCancels) != 1 {
+		t.Errorf("%d early cancels kept, want 1", len(wss.earlyCancels))
+	}
+}
+
+func TestCancelInFlight(t *testing.T) {
+	InitLogger(config.Config{})
+	wss := &WebSocketServer{}
+	req := &HttpRequestMessage{ID: "running"}
+	done := wss.track(req)
+	wss.handleCancel(&CancelMessage{ID: "running"})
+	if !req.cancelled() {
+		t.Error("request not cancelled")
+	}
+	done()
+	if len(wss.earlyCancels) != 0 {
+		t.Error("cancel of a running request kept as an early cancel")
+	}
+}
+
+func TestCancelKeepsSlotUntilUpstreamReturns(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	_, toClient, toServer := startTunnel(t, config.Config{}, config.Config{ALLOW_PRIVATE_NETWORKS: true, MAX_CONCURRENT: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := toClient.Request(ctx, &HttpRequestMessage{Method: "GET", URL: upstream.URL, Headers: map[string][]string{}}, nil)
+		result <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not reach the upstream")
+	}
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Request = %v, want %v", err, context.Canceled)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(toServer.workers); n != 1 {
+		t.Fatalf("%d worker slots taken while the upstream is busy, want 1", n)
+	}
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(toServer.workers) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker slot not released once the upstream returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
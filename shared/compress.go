@@ -0,0 +1,185 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/niradler/go-netbridge/config"
+)
+
+// maxDecodedSize bounds a decompressed body or frame; nothing larger is ever
+// sent in one message.
+const maxDecodedSize = streamFrameSize
+
+// codec compresses message bodies sent over the tunnel.
+type codec struct {
+	name   string
+	encode func([]byte) ([]byte, error)
+	decode func([]byte) ([]byte, error)
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize), zstd.WithDecoderConcurrency(0))
+)
+
+var codecs = map[string]*codec{
+	"zstd": {
+		name: "zstd",
+		encode: func(data []byte) ([]byte, error) {
+			return zstdEncoder.EncodeAll(data, nil), nil
+		},
+		decode: func(data []byte) ([]byte, error) {
+			return zstdDecoder.DecodeAll(data, nil)
+		},
+	},
+	"gzip": {
+		name: "gzip",
+		encode: func(data []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+			if _, err := zw.Write(data); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decode: func(data []byte) ([]byte, error) {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			decoded, err := io.ReadAll(io.LimitReader(zr, maxDecodedSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(decoded) > maxDecodedSize {
+				return nil, fmt.Errorf("gzip: decoded body exceeds %d bytes", maxDecodedSize)
+			}
+			return decoded, nil
+		},
+	},
+}
+
+// compressionOffer lists the codecs this side accepts, in order of preference.
+func compressionOffer(cfg *config.Config) []string {
+	var offer []string
+	for _, name := range cfg.COMPRESSION {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := codecs[name]; ok {
+			offer = append(offer, name)
+		}
+	}
+	return offer
+}
+
+// negotiateCompression picks the first codec of this side's preference that
+// the peer offered, or nil when they have none in common.
+func negotiateCompression(offered string, cfg *config.Config) *codec {
+	return codecs[firstOffered(offered, compressionOffer(cfg))]
+}
+
+// firstOffered returns the first name of preference found in the
+// comma-separated list offered by the peer, empty when there is none.
+func firstOffered(offered string, preference []string) string {
+	peer := make(map[string]bool)
+	for _, name := range strings.Split(offered, ",") {
+		peer[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, name := range preference {
+		if peer[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// incompressibleTypes are media types whose content is compressed already.
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// compressible reports whether a body with these headers may shrink.
+func compressible(headers http.Header) bool {
+	if encoding := headers.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		// Unknown content is tried; the ratio check catches what does not shrink.
+		return true
+	}
+	if incompressibleTypes[mediaType] {
+		return false
+	}
+	major, minor, _ := strings.Cut(mediaType, "/")
+	switch major {
+	case "video", "audio":
+		return false
+	case "image":
+		return minor == "svg+xml" || minor == "bmp" || minor == "x-icon"
+	}
+	return true
+}
+
+// compressBody compresses data with c when it is worth it, returning the data
+// to send and its encoding, empty when sent as is.
+func compressBody(c *codec, data []byte, minSize int) ([]byte, string) {
+	if c == nil {
+		return data, ""
+	}
+	if len(data) < minSize {
+		metrics.compressionSkipped("size")
+		return data, ""
+	}
+	encoded, err := c.encode(data)
+	if err != nil || len(encoded) >= len(data)*9/10 {
+		metrics.compressionSkipped("ratio")
+		return data, ""
+	}
+	metrics.compressed(c.name, len(data), len(encoded))
+	return encoded, c.name
+}
+
+// decodeBody reverses compressBody.
+func decodeBody(data []byte, encoding string) ([]byte, error) {
+	if encoding == "" {
+		return data, nil
+	}
+	c, ok := codecs[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unknown body encoding %q", encoding)
+	}
+	return c.decode(data)
+}
+
+// compressFor returns the codec for a body with these headers, nil when it is
+// sent uncompressed.
+func (wss *WebSocketServer) compressFor(headers http.Header) *codec {
+	if wss.codec == nil {
+		return nil
+	}
+	if !compressible(headers) {
+		metrics.compressionSkipped("content_type")
+		return nil
+	}
+	return wss.codec
+}
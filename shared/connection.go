@@ -0,0 +1,215 @@
+package shared
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/niradler/go-netbridge/tunnel"
+	"go.uber.org/zap"
+)
+
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+type ConnectionStatus struct {
+	State       string     `json:"state"`
+	Reconnects  int        `json:"reconnects"`
+	ConnectedAt *time.Time `json:"connectedAt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Version     string     `json:"version"`                // this build
+	PeerVersion string     `json:"peerVersion,omitempty"`  // the server's build
+	Protocol    int        `json:"protocol,omitempty"`     // tunnel protocol spoken with the server
+	Features    []string   `json:"peerFeatures,omitempty"` // what the server supports
+	RTT         float64    `json:"rttMs,omitempty"`        // latest heartbeat round trip
+}
+
+// WebSocketConnection is the client side of the tunnel. It keeps a
+// connection to the server open, reconnecting with jittered exponential
+// backoff whenever it drops.
+type WebSocketConnection struct {
+	config     *config.Config
+	url        url.URL
+	mu         sync.RWMutex
+	current    *WebSocketServer
+	state      ConnectionState
+	reconnects int
+	lastError  error
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+// NewWebSocketConnection starts connecting to cfg.SOCKET_URL in the background.
+func NewWebSocketConnection(cfg *config.Config) (*WebSocketConnection, error) {
+	wsURL, err := url.Parse(cfg.SOCKET_URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse WebSocket URL: %w", err)
+	}
+
+	wc := &WebSocketConnection{
+		config: cfg,
+		url:    *wsURL,
+		state:  StateConnecting,
+		closed: make(chan struct{}),
+	}
+	go wc.supervise()
+	return wc, nil
+}
+
+// Connection returns the live tunnel connection, if there is one.
+func (wc *WebSocketConnection) Connection() (*WebSocketServer, bool) {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	if wc.state != StateConnected {
+		return nil, false
+	}
+	return wc.current, true
+}
+
+func (wc *WebSocketConnection) State() ConnectionState {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	return wc.state
+}
+
+func (wc *WebSocketConnection) Status() ConnectionStatus {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	status := ConnectionStatus{
+		State:      wc.state.String(),
+		Reconnects: wc.reconnects,
+		Version:    tunnel.Version,
+	}
+	if wc.current != nil && wc.state == StateConnected {
+		status.ConnectedAt = &wc.current.ConnectedAt
+		status.PeerVersion = wc.current.peer.Version
+		status.Protocol = wc.current.protocol
+		status.Features = wc.current.peer.Features
+		status.RTT = float64(wc.current.RTT().Microseconds()) / 1000
+	}
+	if wc.lastError != nil {
+		status.LastError = wc.lastError.Error()
+	}
+	return status
+}
+
+// Close stops reconnecting and closes the current connection.
+func (wc *WebSocketConnection) Close() {
+	wc.closeOnce.Do(func() {
+		close(wc.closed)
+		wc.mu.Lock()
+		current := wc.current
+		wc.state = StateClosed
+		wc.mu.Unlock()
+		if current != nil {
+			current.Close()
+		}
+	})
+}
+
+func (wc *WebSocketConnection) setState(state ConnectionState, current *WebSocketServer, err error) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.state == StateClosed {
+		return
+	}
+	wc.state = state
+	wc.current = current
+	if err != nil {
+		wc.lastError = err
+	}
+}
+
+func (wc *WebSocketConnection) supervise() {
+	logger := GetLogger()
+	attempt := 0
+	connected := false
+	for {
+		client, header, err := tunnel.Connect(wc.url, *wc.config, localHello(wc.config))
+		var peer tunnel.Hello
+		var protocol int
+		if err == nil {
+			if peer, protocol, err = greet(header.Get(tunnel.HelloHeader)); err != nil {
+				client.Close()
+			}
+		}
+		if err != nil {
+			delay := backoff(attempt, wc.config.RECONNECT_MIN_DELAY, wc.config.RECONNECT_MAX_DELAY)
+			attempt++
+			logger.Warn("Failed to connect to WebSocket server", zap.Int("attempt", attempt), zap.Duration("retryIn", delay), zap.String("error", err.Error()))
+			wc.setState(StateDisconnected, nil, err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-wc.closed:
+				return
+			}
+		}
+
+		wss := newWebSocketServer(client, wc.config)
+		wss.RemoteAddr = wc.url.Host
+		wss.peer, wss.protocol = peer, protocol
+		wss.codec = negotiateCompression(header.Get(tunnel.CompressionHeader), wc.config)
+		// A server that predates framing negotiation sends no header: json.
+		wss.useFraming(negotiateFraming(header.Get(tunnel.FramingHeader), wc.config))
+		wss.listen()
+
+		if connected {
+			wc.mu.Lock()
+			wc.reconnects++
+			wc.mu.Unlock()
+		}
+		wc.setState(StateConnected, wss, nil)
+		connected = true
+		attempt = 0
+		logger.Info("WebSocket connected", zap.String("url", wc.url.String()), zap.String("version", peer.Version), zap.Int("protocol", protocol), zap.String("compression", header.Get(tunnel.CompressionHeader)), zap.String("framing", wss.framing))
+
+		select {
+		case <-wss.Done():
+			// In-flight requests on this connection fail with ErrTunnelClosed.
+			client.Close()
+			logger.Warn("WebSocket connection lost, reconnecting", zap.Duration("lastRTT", wss.RTT()))
+			wc.setState(StateConnecting, nil, ErrTunnelClosed)
+		case <-wc.closed:
+			wss.Close()
+			return
+		}
+	}
+}
+
+// backoff returns the delay before retry attempt n: exponential growth
+// from min capped at max, with the upper half randomized.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const eventStreamType = "text/event-stream"
+
+// isIncrementalResponse reports whether a response body is produced over
+// time, Server-Sent Events or chunked transfer encoding, and must be relayed
+// as it arrives instead of being buffered.
+func isIncrementalResponse(headers http.Header) bool {
+	if mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type")); err == nil && mediaType == eventStreamType {
+		return true
+	}
+	return headerContainsToken(headers, "Transfer-Encoding", "chunked")
+}
+
+// acceptsEventStream reports whether the caller asked for Server-Sent Events.
+func acceptsEventStream(headers http.Header) bool {
+	for _, value := range headers.Values("Accept") {
+		if strings.Contains(value, eventStreamType) {
+			return true
+		}
+	}
+	return false
+}
+
+// flushWriter flushes the response after every write so the caller sees
+// each chunk as soon as it arrives.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.rc.Flush()
+}
@@ -0,0 +1,179 @@
+package shared
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/niradler/socketflow"
+)
+
+// Tunnel messages are encoded in one of two framings. With json, the original
+// one, the socketflow envelope and the message inside it are both JSON, so a
+// body is base64 encoded twice. With binary the envelope is a few
+// length-prefixed fields and the message is a JSON header block followed by
+// the raw body, sent as a binary WebSocket frame. Either side decodes both,
+// telling them apart by the first byte, so the negotiated framing only
+// decides what a side sends.
+const (
+	framingBinary = "binary"
+	framingJSON   = "json"
+
+	// binaryMagic starts binary envelopes and payloads; JSON starts with '{'.
+	binaryMagic = 0xb1
+	chunkFlag   = 1 << 0
+)
+
+var errShortFrame = errors.New("truncated binary frame")
+
+// framingOffer lists the framings this side accepts, in order of preference.
+func framingOffer(cfg *config.Config) []string {
+	var offer []string
+	for _, name := range cfg.FRAMING {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == framingBinary || name == framingJSON {
+			offer = append(offer, name)
+		}
+	}
+	return offer
+}
+
+// negotiateFraming picks the first framing of this side's preference that the
+// peer offered. Peers that offer none predate binary framing and get json.
+func negotiateFraming(offered string, cfg *config.Config) string {
+	if name := firstOffered(offered, framingOffer(cfg)); name != "" {
+		return name
+	}
+	return framingJSON
+}
+
+// useFraming makes wss send its messages in the given framing.
+func (wss *WebSocketServer) useFraming(name string) {
+	wss.framing = name
+	wss.streams.framing = name
+	if name == framingBinary {
+		wss.conn.UseBinaryFrames(envelopeSerializer{binary: true})
+	} else {
+		wss.conn.SetSerializer(envelopeSerializer{})
+	}
+}
+
+// envelopeSerializer encodes socketflow envelopes, as JSON or in binary:
+// magic, flags, ID, topic, chunk index and count for chunks, then the payload.
+type envelopeSerializer struct {
+	binary bool
+}
+
+func (s envelopeSerializer) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(*socketflow.Message)
+	if !ok || !s.binary {
+		return json.Marshal(v)
+	}
+	buf := make([]byte, 0, 2+4*binary.MaxVarintLen32+len(msg.ID)+len(msg.Topic)+len(msg.Payload))
+	var flags byte
+	if msg.IsChunk {
+		flags |= chunkFlag
+	}
+	buf = append(buf, binaryMagic, flags)
+	buf = appendField(buf, []byte(msg.ID))
+	buf = appendField(buf, []byte(msg.Topic))
+	if msg.IsChunk {
+		buf = binary.AppendUvarint(buf, uint64(msg.Chunk))
+		buf = binary.AppendUvarint(buf, uint64(msg.TotalChunks))
+	}
+	return append(buf, msg.Payload...), nil
+}
+
+func (s envelopeSerializer) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*socketflow.Message)
+	if !ok || len(data) == 0 || data[0] != binaryMagic {
+		return json.Unmarshal(data, v)
+	}
+	if len(data) < 2 {
+		return errShortFrame
+	}
+	flags, rest := data[1], data[2:]
+	id, rest, err := readField(rest)
+	if err != nil {
+		return err
+	}
+	topic, rest, err := readField(rest)
+	if err != nil {
+		return err
+	}
+	*msg = socketflow.Message{ID: string(id), Topic: string(topic)}
+	if flags&chunkFlag != 0 {
+		var chunk, total uint64
+		if chunk, rest, err = readUvarint(rest); err != nil {
+			return err
+		}
+		if total, rest, err = readUvarint(rest); err != nil {
+			return err
+		}
+		msg.IsChunk, msg.Chunk, msg.TotalChunks = true, int(chunk), int(total)
+	}
+	msg.Payload = rest
+	return nil
+}
+
+// marshalPayload encodes a message carrying a body. In binary framing the
+// message without its body becomes the header block and the body follows as
+// is. body points at the body field of v.
+func marshalPayload(framing string, v interface{}, body *[]byte) ([]byte, error) {
+	if framing != framingBinary {
+		return json.Marshal(v)
+	}
+	data := *body
+	*body = nil
+	header, err := json.Marshal(v)
+	*body = data
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 1+binary.MaxVarintLen32+len(header)+len(data))
+	buf = append(buf, binaryMagic)
+	buf = appendField(buf, header)
+	return append(buf, data...), nil
+}
+
+// unmarshalPayload decodes a message encoded by marshalPayload in either framing.
+func unmarshalPayload(payload []byte, v interface{}, body *[]byte) error {
+	if len(payload) == 0 || payload[0] != binaryMagic {
+		return json.Unmarshal(payload, v)
+	}
+	header, data, err := readField(payload[1:])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(header, v); err != nil {
+		return err
+	}
+	*body = data
+	return nil
+}
+
+func appendField(buf, field []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(field)))
+	return append(buf, field...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errShortFrame
+	}
+	return v, data[n:], nil
+}
+
+func readField(data []byte) ([]byte, []byte, error) {
+	n, rest, err := readUvarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n > uint64(len(rest)) {
+		return nil, nil, errShortFrame
+	}
+	return rest[:n], rest[n:], nil
+}
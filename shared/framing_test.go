@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/niradler/socketflow"
+)
+
+// framingCase is a message as it crosses the tunnel: body is its body field.
+type framingCase struct {
+	name  string
+	topic string
+	new   func() (interface{}, *[]byte)
+}
+
+func framingCases() []framingCase {
+	rng := rand.New(rand.NewSource(1))
+	small := make([]byte, 1024)
+	rng.Read(small)
+	frame := make([]byte, streamFrameSize)
+	rng.Read(frame)
+
+	return []framingCase{
+		{"response-1KiB", "response", func() (interface{}, *[]byte) {
+			res := &HttpResponseMessage{
+				ID:         "0d6c1f9e-5b7a-4c0e-9f3a-2b8e7d4c1a60",
+				StatusCode: 200,
+				Headers: map[string][]string{
+					"Content-Type":  {"application/json"},
+					"Cache-Control": {"no-cache"},
+					"Date":          {"Fri, 16 Oct 2026 12:00:00 GMT"},
+				},
+				Body: small,
+			}
+			return res, &res.Body
+		}},
+		{"frame-32KiB", "stream", func() (interface{}, *[]byte) {
+			f := &StreamFrame{ID: "0d6c1f9e-5b7a-4c0e-9f3a-2b8e7d4c1a60", Seq: 7, Data: frame}
+			return f, &f.Data
+		}},
+	}
+}
+
+// encodeMessage encodes v the way it goes on the wire, payload and envelope.
+func encodeMessage(framing, topic string, v interface{}, body *[]byte) ([]byte, error) {
+	payload, err := marshalPayload(framing, v, body)
+	if err != nil {
+		return nil, err
+	}
+	s := envelopeSerializer{binary: framing == framingBinary}
+	return s.Marshal(&socketflow.Message{ID: "1f0e4c2a-9d3b-4e5f-8a7c-6b1d2e3f4a50", Topic: topic, Payload: payload})
+}
+
+func BenchmarkMarshalPayload(b *testing.B) {
+	for _, framing := range []string{framingJSON, framingBinary} {
+		for _, c := range framingCases() {
+			b.Run(framing+"/"+c.name, func(b *testing.B) {
+				v, body := c.new()
+				var wire []byte
+				b.SetBytes(int64(len(*body)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var err error
+					if wire, err = encodeMessage(framing, c.topic, v, body); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(wire)), "wire-bytes")
+			})
+		}
+	}
+}
+
+func BenchmarkUnmarshalPayload(b *testing.B) {
+	for _, framing := range []string{framingJSON, framingBinary} {
+		for _, c := range framingCases() {
+			b.Run(framing+"/"+c.name, func(b *testing.B) {
+				v, body := c.new()
+				wire, err := encodeMessage(framing, c.topic, v, body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				s := envelopeSerializer{binary: framing == framingBinary}
+				b.SetBytes(int64(len(*body)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var msg socketflow.Message
+					if err := s.Unmarshal(wire, &msg); err != nil {
+						b.Fatal(err)
+					}
+					out, outBody := c.new()
+					*outBody = nil
+					if err := unmarshalPayload(msg.Payload, out, outBody); err != nil {
+						b.Fatal(err)
+					}
+					if len(*outBody) != len(*body) {
+						b.Fatalf("decoded %d body bytes, want %d", len(*outBody), len(*body))
+					}
+				}
+				b.ReportMetric(float64(len(wire)), "wire-bytes")
+			})
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package shared
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/tunnel"
+	"go.uber.org/zap"
+)
+
+// Heartbeat is sent on the "ping" topic and echoed back on "pong".
+type Heartbeat struct {
+	Seq uint64 `json:"seq"`
+}
+
+// heartbeat tracks the pings sent to the peer. A pong answers its ping and
+// every earlier one, so a peer slower than HEARTBEAT_INTERVAL is not taken
+// for a dead one as long as its pongs keep arriving.
+type heartbeat struct {
+	mu          sync.Mutex
+	seq         uint64
+	outstanding map[uint64]time.Time // unanswered pings by sequence, with the time they were sent
+	rtt         time.Duration
+}
+
+// startHeartbeat pings the peer every HEARTBEAT_INTERVAL and closes the
+// connection once HEARTBEAT_MISSES pings in a row went unanswered, which a
+// half-open TCP connection would otherwise hide until the next request.
+func (wss *WebSocketServer) startHeartbeat() {
+	if !wss.peer.Has(tunnel.FeatureHeartbeat) {
+		GetLogger().Info("Peer does not answer heartbeats, not monitoring it", zap.String("client", wss.Name), zap.String("version", wss.peer.Version))
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(wss.config.HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !wss.ping() {
+					wss.Client.Close()
+					return
+				}
+			case <-wss.done:
+				return
+			}
+		}
+	}()
+}
+
+// ping sends the next ping and reports false once the peer is considered dead.
+func (wss *WebSocketServer) ping() bool {
+	logger := GetLogger()
+	hb := &wss.heartbeat
+	hb.mu.Lock()
+	if hb.outstanding == nil {
+		hb.outstanding = make(map[uint64]time.Time)
+	}
+	misses, rtt := len(hb.outstanding), hb.rtt
+	if misses > 0 {
+		metrics.heartbeatMissed()
+	}
+	hb.seq++
+	hb.outstanding[hb.seq] = time.Now()
+	seq := hb.seq
+	hb.mu.Unlock()
+
+	if misses >= wss.config.HEARTBEAT_MISSES {
+		logger.Error("Tunnel peer stopped answering heartbeats, closing the connection", zap.String("client", wss.Name), zap.String("remoteAddr", wss.RemoteAddr), zap.Int("misses", misses), zap.Duration("lastRTT", rtt))
+		return false
+	}
+	if misses > 0 {
+		logger.Warn("Tunnel heartbeat missed", zap.String("client", wss.Name), zap.Int("misses", misses), zap.Duration("lastRTT", rtt))
+	}
+
+	payload, err := json.Marshal(Heartbeat{Seq: seq})
+	if err != nil {
+		return true
+	}
+	// A write to a dead peer can block until the kernel gives up on it; the
+	// next tick counts the miss regardless.
+	go sendMessage(wss.conn, "ping", payload)
+	return true
+}
+
+func (wss *WebSocketServer) handlePing(hb *Heartbeat) {
+	payload, err := json.Marshal(hb)
+	if err != nil {
+		return
+	}
+	// Answer off the subscriber goroutine, which a blocked write would stall.
+	go func() {
+		if _, err := sendMessage(wss.conn, "pong", payload); err != nil {
+			GetLogger().Debug("Failed to answer heartbeat", zap.String("error", err.Error()))
+		}
+	}()
+}
+
+func (wss *WebSocketServer) handlePong(pong *Heartbeat) {
+	hb := &wss.heartbeat
+	hb.mu.Lock()
+	sentAt, ok := hb.outstanding[pong.Seq]
+	if !ok {
+		hb.mu.Unlock()
+		return
+	}
+	for seq := range hb.outstanding {
+		if seq <= pong.Seq {
+			delete(hb.outstanding, seq)
+		}
+	}
+	hb.rtt = time.Since(sentAt)
+	rtt := hb.rtt
+	hb.mu.Unlock()
+	metrics.heartbeatRTT(rtt)
+	GetLogger().Debug("Tunnel heartbeat", zap.String("client", wss.Name), zap.Duration("rtt", rtt))
+}
+
+// RTT returns the round-trip time of the latest answered heartbeat, zero
+// before the first one.
+func (wss *WebSocketServer) RTT() time.Duration {
+	wss.heartbeat.mu.Lock()
+	defer wss.heartbeat.mu.Unlock()
+	return wss.heartbeat.rtt
+}
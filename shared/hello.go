@@ -0,0 +1,26 @@
+package shared
+
+import (
+	"github.com/niradler/go-netbridge/config"
+	"github.com/niradler/go-netbridge/tunnel"
+)
+
+// localHello returns the Hello this side introduces itself with.
+func localHello(cfg *config.Config) tunnel.Hello {
+	features := []string{tunnel.FeatureStreaming, tunnel.FeatureTCP, tunnel.FeatureHeartbeat, tunnel.FeatureDrain}
+	if len(compressionOffer(cfg)) > 0 {
+		features = append(features, tunnel.FeatureCompression)
+	}
+	return tunnel.NewHello(features...)
+}
+
+// greet checks the Hello the peer sent on the handshake and returns it along
+// with the protocol version both sides speak.
+func greet(value string) (tunnel.Hello, int, error) {
+	peer, err := tunnel.ParseHello(value)
+	if err != nil {
+		return peer, 0, err
+	}
+	protocol, err := tunnel.Negotiate(peer)
+	return peer, protocol, err
+}
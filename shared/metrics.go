@@ -0,0 +1,356 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	rttBuckets     = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+// series is one labeled value of a metric. Histograms keep a cumulative count
+// per bucket, the last one being +Inf.
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64
+}
+
+// metricVec is a counter or histogram with labels, written in the Prometheus
+// text exposition format.
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*series
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: make(map[string]*series)}
+}
+
+func (m *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to a counter.
+func (m *metricVec) add(delta float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).value += delta
+}
+
+// observe records a histogram sample.
+func (m *metricVec) observe(sample float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	for i, bound := range m.buckets {
+		if sample <= bound {
+			s.counts[i]++
+		}
+	}
+	s.counts[len(m.buckets)]++
+	s.value += sample
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeHeader(w, m.name, m.help, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			writeSample(w, m.name, m.labels, s.labels, s.value)
+			continue
+		}
+		labels := append(m.labels[:len(m.labels):len(m.labels)], "le")
+		for i, count := range s.counts {
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = formatFloat(m.buckets[i])
+			}
+			writeSample(w, m.name+"_bucket", labels, append(s.labels[:len(s.labels):len(s.labels)], le), float64(count))
+		}
+		writeSample(w, m.name+"_sum", m.labels, s.labels, s.value)
+		writeSample(w, m.name+"_count", m.labels, s.labels, float64(s.counts[len(m.buckets)]))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = label + `="` + labelEscaper.Replace(values[i]) + `"`
+		}
+		io.WriteString(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	io.WriteString(w, " "+formatFloat(value)+"\n")
+}
+
+// writeGauge writes a metric with a single unlabeled value.
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	writeSample(w, name, nil, nil, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics holds the process-wide counters exposed on /_metrics.
+type Metrics struct {
+	requests     *metricVec
+	latency      *metricVec
+	tunnelBytes  *metricVec
+	rejections   *metricVec
+	compressIn   *metricVec
+	compressOut  *metricVec
+	uncompressed *metricVec
+	rtt          *metricVec
+	misses       *metricVec
+	inFlight     atomic.Int64
+}
+
+var metrics = &Metrics{
+	requests:     newCounterVec("netbridge_http_requests_total", "Proxied HTTP requests.", "method", "status", "host"),
+	latency:      newHistogramVec("netbridge_http_request_duration_seconds", "Time to serve proxied HTTP requests, body included.", latencyBuckets, "method", "status", "host"),
+	tunnelBytes:  newCounterVec("netbridge_tunnel_bytes_total", "Message payload bytes sent and received over tunnels.", "direction"),
+	rejections:   newCounterVec("netbridge_egress_rejections_total", "Upstream requests rejected by the egress policy or the dial guard.", "reason"),
+	compressIn:   newCounterVec("netbridge_compression_input_bytes_total", "Body bytes compressed for the tunnel, before compression.", "codec"),
+	compressOut:  newCounterVec("netbridge_compression_output_bytes_total", "Body bytes compressed for the tunnel, after compression.", "codec"),
+	uncompressed: newCounterVec("netbridge_compression_skipped_total", "Bodies and frames sent uncompressed although compression was negotiated.", "reason"),
+	rtt:          newHistogramVec("netbridge_tunnel_heartbeat_rtt_seconds", "Round-trip time of tunnel heartbeats.", rttBuckets),
+	misses:       newCounterVec("netbridge_tunnel_heartbeat_misses_total", "Tunnel heartbeats the peer did not answer in time."),
+}
+
+func (m *Metrics) tunnelSent(n int)     { m.tunnelBytes.add(float64(n), "out") }
+func (m *Metrics) tunnelReceived(n int) { m.tunnelBytes.add(float64(n), "in") }
+func (m *Metrics) rejected(reason string) {
+	m.rejections.add(1, reason)
+}
+
+func (m *Metrics) compressed(codec string, in, out int) {
+	m.compressIn.add(float64(in), codec)
+	m.compressOut.add(float64(out), codec)
+}
+
+func (m *Metrics) compressionSkipped(reason string) {
+	m.uncompressed.add(1, reason)
+}
+
+func (m *Metrics) heartbeatRTT(rtt time.Duration) { m.rtt.observe(rtt.Seconds()) }
+func (m *Metrics) heartbeatMissed()               { m.misses.add(1) }
+
+// instrument records the count, latency and status of the requests served by
+// next, and traces them.
+func (hs *HTTPServer) instrument(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.inFlight.Add(1)
+		defer metrics.inFlight.Add(-1)
+		start := time.Now()
+		host := hs.metricsHost(r)
+		span := tracerFor(hs.config).Start("proxy "+r.Method, spanKindServer, nil, r.Header.Get("traceparent"))
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("server.address", r.Host)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next(ww, r.WithContext(contextWithSpan(r.Context(), span)))
+
+		status := ww.Status()
+		if status == 0 {
+			// Hijacked for an upgrade, or nothing written.
+			status = http.StatusSwitchingProtocols
+			if !isUpgradeRequest(r) {
+				status = http.StatusOK
+			}
+		}
+		span.SetAttribute("http.response.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.Fail(errors.New(http.StatusText(status)))
+		}
+		span.End()
+
+		labels := []string{metricsMethod(r.Method), strconv.Itoa(status), host}
+		metrics.requests.add(1, labels...)
+		metrics.latency.observe(time.Since(start).Seconds(), labels...)
+	}
+}
+
+// metricsHost returns the host label of a request. The caller's headers are
+// not used as is, so the label only takes a few values: the published service
+// or client the server routes the request to, the configured X_Forwarded_Host,
+// or "other".
+func (hs *HTTPServer) metricsHost(r *http.Request) string {
+	if hs.tunnel == nil {
+		if _, service, _, ok := hs.clients.RouteService(r, hs.config.PUBLIC_DOMAIN); ok {
+			return service
+		}
+		proxyType := r.Header.Get("X-Proxy-Type")
+		if proxyType == "" {
+			proxyType = hs.config.PROXY_TYPE
+		}
+		if proxyType != "server" && proxyType != "proxy" {
+			if wss, _, ok := hs.clients.Route(r); ok {
+				return wss.Name
+			}
+		}
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); hs.config.X_Forwarded_Host != "" && (host == "" || host == hs.config.X_Forwarded_Host) {
+		return hs.config.X_Forwarded_Host
+	}
+	return "other"
+}
+
+// metricsMethod returns the method label of a request, "OTHER" for methods
+// outside the standard ones.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// writeMetrics writes all metrics, with the gauges read from their sources.
+func (hs *HTTPServer) writeMetrics(w io.Writer) {
+	metrics.requests.writeTo(w)
+	metrics.latency.writeTo(w)
+	writeGauge(w, "netbridge_http_requests_in_flight", "Proxied HTTP requests being served.", float64(metrics.inFlight.Load()))
+	metrics.tunnelBytes.writeTo(w)
+	metrics.rejections.writeTo(w)
+	metrics.compressIn.writeTo(w)
+	metrics.compressOut.writeTo(w)
+	metrics.uncompressed.writeTo(w)
+	metrics.writeCompressionRatio(w)
+	metrics.rtt.writeTo(w)
+	metrics.misses.writeTo(w)
+
+	var active, queued int64
+	if hs.tunnel != nil {
+		writeHeader(w, "netbridge_tunnel_reconnects_total", "Times the tunnel connection was re-established.", "counter")
+		writeSample(w, "netbridge_tunnel_reconnects_total", nil, nil, float64(hs.tunnel.Status().Reconnects))
+		connected, rtt := 0, time.Duration(0)
+		if wss, ok := hs.tunnel.Connection(); ok {
+			connected = 1
+			active, queued = wss.active.Load(), wss.queued.Load()
+			rtt = wss.RTT()
+		}
+		writeGauge(w, "netbridge_tunnel_connected", "Whether the tunnel connection is up.", float64(connected))
+		writeGauge(w, "netbridge_tunnel_rtt_seconds", "Round-trip time of the latest answered heartbeat.", rtt.Seconds())
+	} else {
+		clients := hs.clients.List()
+		for _, client := range clients {
+			active += client.ActiveRequests
+			queued += client.QueuedRequests
+		}
+		writeGauge(w, "netbridge_connected_clients", "Tunnel clients connected to this server.", float64(len(clients)))
+		writeHeader(w, "netbridge_tunnel_rtt_seconds", "Round-trip time of the latest answered heartbeat per client.", "gauge")
+		for _, client := range clients {
+			writeSample(w, "netbridge_tunnel_rtt_seconds", []string{"client"}, []string{client.Name}, client.RTT/1000)
+		}
+	}
+	writeGauge(w, "netbridge_tunnel_requests_active", "Requests from the peer being handled.", float64(active))
+	writeGauge(w, "netbridge_tunnel_requests_queued", "Requests from the peer waiting for a MAX_CONCURRENT slot.", float64(queued))
+
+	// Destinations requested by the peer are not labelled with their address,
+	// which the peer controls, but summed up as "other". Trusted and untrusted
+	// requests to one destination use separate clients.
+	var stats []UpstreamStats
+	index := make(map[UpstreamStats]int)
+	for _, s := range upstreamPoolFor(hs.config).Stats() {
+		key := UpstreamStats{Addr: s.Addr, TLS: s.TLS}
+		if !s.Trusted {
+			key.Addr = "other"
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(stats)
+			index[key] = i
+			stats = append(stats, key)
+		}
+		stats[i].Conns += s.Conns
+		stats[i].InFlight += s.InFlight
+		stats[i].Requests += s.Requests
+		stats[i].Errors += s.Errors
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	upstreams := []struct {
+		name, help, kind string
+		value            func(UpstreamStats) float64
+	}{
+		{"netbridge_upstream_connections", "Open connections per upstream destination.", "gauge", func(s UpstreamStats) float64 { return float64(s.Conns) }},
+		{"netbridge_upstream_requests_in_flight", "Requests in flight per upstream destination.", "gauge", func(s UpstreamStats) float64 { return float64(s.InFlight) }},
+		{"netbridge_upstream_requests_total", "Requests per upstream destination, as long as its client is pooled.", "counter", func(s UpstreamStats) float64 { return float64(s.Requests) }},
+		{"netbridge_upstream_errors_total", "Failed requests per upstream destination, as long as its client is pooled.", "counter", func(s UpstreamStats) float64 { return float64(s.Errors) }},
+	}
+	for _, m := range upstreams {
+		writeHeader(w, m.name, m.help, m.kind)
+		for _, s := range stats {
+			writeSample(w, m.name, []string{"addr", "tls"}, []string{s.Addr, strconv.FormatBool(s.TLS)}, m.value(s))
+		}
+	}
+}
+
+// writeCompressionRatio writes the compressed size as a share of the original
+// size per codec, so 0.25 means bodies shrank to a quarter.
+func (m *Metrics) writeCompressionRatio(w io.Writer) {
+	m.compressIn.mu.Lock()
+	m.compressOut.mu.Lock()
+	defer m.compressIn.mu.Unlock()
+	defer m.compressOut.mu.Unlock()
+	const name = "netbridge_compression_ratio"
+	writeHeader(w, name, "Compressed body size relative to the original size.", "gauge")
+	codecs := make([]string, 0, len(m.compressIn.series))
+	for key := range m.compressIn.series {
+		codecs = append(codecs, key)
+	}
+	sort.Strings(codecs)
+	for _, codec := range codecs {
+		in := m.compressIn.series[codec].value
+		if out, ok := m.compressOut.series[codec]; ok && in > 0 {
+			writeSample(w, name, []string{"codec"}, []string{codec}, out.value/in)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrRequestTimeout = errors.New("request timed out")
+
+type pendingRequest struct {
+	response chan *HttpResponseMessage
+	deadline time.Time
+}
+
+// PendingRequests tracks requests sent over the tunnel that are still waiting
+// for a response, keyed by the request message ID.
+type PendingRequests struct {
+	mu       sync.Mutex
+	requests map[string]*pendingRequest
+}
+
+func NewPendingRequests() *PendingRequests {
+	return &PendingRequests{
+		requests: make(map[string]*pendingRequest),
+	}
+}
+
+// Add registers a request ID and returns the channel its response will be delivered on.
+func (p *PendingRequests) Add(id string, timeout time.Duration) <-chan *HttpResponseMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr := &pendingRequest{
+		response: make(chan *HttpResponseMessage, 1),
+		deadline: time.Now().Add(timeout),
+	}
+	p.requests[id] = pr
+	return pr.response
+}
+
+// Resolve delivers a response to the caller waiting on its request ID.
+// It returns false when no caller is waiting (timed out or unknown ID).
+func (p *PendingRequests) Resolve(res *HttpResponseMessage) bool {
+	p.mu.Lock()
+	pr, ok := p.requests[res.ID]
+	if ok {
+		delete(p.requests, res.ID)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	pr.response <- res
+	return true
+}
+
+// Remove drops a request ID without delivering a response.
+func (p *PendingRequests) Remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.requests, id)
+}
+
+// Len returns the number of requests waiting for a response.
+func (p *PendingRequests) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.requests)
+}
+
+// Sweep removes entries whose deadline has passed and closes their channels.
+func (p *PendingRequests) Sweep(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	removed := 0
+	for id, pr := range p.requests {
+		if now.After(pr.deadline) {
+			close(pr.response)
+			delete(p.requests, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartSweeper periodically removes orphaned entries until done is closed.
+func (p *PendingRequests) StartSweeper(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if removed := p.Sweep(now); removed > 0 {
+					GetLogger().Warn("Removed orphaned pending requests", zap.Int("count", removed))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
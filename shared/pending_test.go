@@ -0,0 +1,116 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+func TestPendingRequests(t *testing.T) {
+	p := NewPendingRequests()
+	a := p.Add("a", time.Minute)
+	b := p.Add("b", time.Minute)
+
+	if !p.Resolve(&HttpResponseMessage{ID: "b", StatusCode: 201}) {
+		t.Fatal("Resolve(b) found no caller")
+	}
+	if res := <-b; res.StatusCode != 201 {
+		t.Errorf("b received status %d, want 201", res.StatusCode)
+	}
+	select {
+	case res := <-a:
+		t.Errorf("a received %+v meant for another request", res)
+	default:
+	}
+	if p.Resolve(&HttpResponseMessage{ID: "b"}) {
+		t.Error("Resolve(b) delivered a second response")
+	}
+	if p.Resolve(&HttpResponseMessage{ID: "unknown"}) {
+		t.Error("Resolve delivered a response for an unknown ID")
+	}
+
+	p.Remove("a")
+	if p.Len() != 0 {
+		t.Errorf("Len() = %d after Remove, want 0", p.Len())
+	}
+}
+
+func TestPendingRequestsSweep(t *testing.T) {
+	p := NewPendingRequests()
+	expired := p.Add("expired", time.Second)
+	p.Add("live", time.Hour)
+
+	if removed := p.Sweep(time.Now().Add(time.Minute)); removed != 1 {
+		t.Errorf("Sweep removed %d requests, want 1", removed)
+	}
+	if _, ok := <-expired; ok {
+		t.Error("swept request received a response, want its channel closed")
+	}
+	if p.Len() != 1 {
+		t.Errorf("Len() = %d after Sweep, want 1", p.Len())
+	}
+	if !p.Resolve(&HttpResponseMessage{ID: "live"}) {
+		t.Error("live request was swept")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	InitLogger(config.Config{})
+	orphan := p.Add("orphan", time.Millisecond)
+	p.StartSweeper(10*time.Millisecond, done)
+	select {
+	case _, ok := <-orphan:
+		if ok {
+			t.Error("orphaned request received a response")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("sweeper did not remove the orphaned request")
+	}
+}
+
+func TestConcurrentRequestsGetTheirOwnResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Answer out of order so responses overtake each other.
+		n := 0
+		fmt.Sscan(r.URL.Query().Get("n"), &n)
+		time.Sleep(time.Duration(n%5) * 10 * time.Millisecond)
+		io.WriteString(w, r.URL.Query().Get("n"))
+	}))
+	defer upstream.Close()
+
+	_, toClient, _ := startTunnel(t, config.Config{}, config.Config{ALLOW_PRIVATE_NETWORKS: true, MAX_CONCURRENT: 50})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprint(i)
+			res, body, err := toClient.Request(context.Background(), &HttpRequestMessage{
+				Method:  "GET",
+				URL:     upstream.URL + "/?n=" + want,
+				Headers: map[string][]string{},
+			}, nil)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			defer body.Close()
+			got, _ := io.ReadAll(body)
+			if res.StatusCode != http.StatusOK || string(got) != want {
+				t.Errorf("request %d got %d %q", i, res.StatusCode, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := toClient.pending.Len(); n != 0 {
+		t.Errorf("%d requests still pending", n)
+	}
+}
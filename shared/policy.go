@@ -0,0 +1,300 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/valyala/fasthttp"
+)
+
+const policyResolveTimeout = 5 * time.Second
+
+var ErrRequestNotAllowed = errors.New("Request not allowed")
+
+// egressRulePattern parses "[METHOD|METHOD ][scheme://]host[:port][/path]".
+// host is an exact name, "*.domain" for its subdomains, "*" for any host, an
+// IP or CIDR range, or either of those in brackets for IPv6.
+var egressRulePattern = regexp.MustCompile(`^(?:([A-Za-z|]+)\s+)?(?:([A-Za-z][A-Za-z0-9+.-]*)://)?(\[[^\]]+\]|\d{1,3}(?:\.\d{1,3}){3}(?:/\d{1,2})?|[^/:\s\[\]]+)(?::(\d+|\*))?(/\S*)?$`)
+
+// EgressRule is a single WHITE_LIST or DENY_LIST entry. Empty fields match anything.
+type EgressRule struct {
+	Methods []string
+	Scheme  string
+	Host    string
+	Network *net.IPNet
+	Port    int
+	Path    string
+}
+
+func ParseEgressRule(entry string) (EgressRule, error) {
+	m := egressRulePattern.FindStringSubmatch(strings.TrimSpace(entry))
+	if m == nil {
+		return EgressRule{}, fmt.Errorf("invalid egress rule %q", entry)
+	}
+
+	rule := EgressRule{
+		Scheme: strings.ToLower(m[2]),
+		Path:   m[5],
+	}
+	if m[1] != "" {
+		rule.Methods = strings.Split(strings.ToUpper(m[1]), "|")
+	}
+	if m[4] != "" && m[4] != "*" {
+		port, err := strconv.Atoi(m[4])
+		if err != nil || port > 65535 {
+			return EgressRule{}, fmt.Errorf("invalid port in egress rule %q", entry)
+		}
+		rule.Port = port
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(m[3], "["), "]")
+	if strings.Contains(host, "/") {
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return EgressRule{}, fmt.Errorf("invalid CIDR in egress rule %q: %w", entry, err)
+		}
+		rule.Network = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if strings.HasPrefix(m[3], "[") {
+		return EgressRule{}, fmt.Errorf("invalid address in egress rule %q", entry)
+	} else {
+		rule.Host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return rule, nil
+}
+
+// egressTarget is the part of a request egress rules are matched against.
+type egressTarget struct {
+	method string
+	scheme string
+	host   string
+	port   int
+	path   string
+	addrs  []net.IP
+}
+
+var defaultPorts = map[string]int{"http": 80, "ws": 80, "https": 443, "wss": 443}
+
+func newEgressTarget(req *HttpRequestMessage) (*egressTarget, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in %q", req.URL)
+	}
+	// fasthttp makes the request and reads some URLs differently from
+	// net/url: it sends "http://a.example#@b.example" to b.example.
+	if u.User != nil || strings.Contains(req.URL, "#") {
+		return nil, fmt.Errorf("userinfo or fragment in %q", req.URL)
+	}
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+	if err := uri.Parse(nil, []byte(req.URL)); err != nil || !strings.EqualFold(string(uri.Host()), u.Host) {
+		return nil, fmt.Errorf("ambiguous host in %q", req.URL)
+	}
+	t := &egressTarget{
+		method: strings.ToUpper(req.Method),
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")),
+		port:   defaultPorts[strings.ToLower(u.Scheme)],
+		path:   u.Path,
+	}
+	if u.Port() != "" {
+		if t.port, err = strconv.Atoi(u.Port()); err != nil {
+			return nil, fmt.Errorf("invalid port in %q", req.URL)
+		}
+	}
+	if ip := net.ParseIP(t.host); ip != nil {
+		t.addrs = []net.IP{ip}
+	}
+	return t, nil
+}
+
+// resolve looks up the addresses of the target host once, for CIDR rules.
+func (t *egressTarget) resolve() []net.IP {
+	if t.addrs != nil {
+		return t.addrs
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), policyResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, t.host)
+	t.addrs = []net.IP{}
+	if err != nil {
+		return t.addrs
+	}
+	for _, addr := range addrs {
+		t.addrs = append(t.addrs, addr.IP)
+	}
+	return t.addrs
+}
+
+// match reports whether the rule covers t. A CIDR rule matches a hostname when
+// all of its addresses are in range, or for a deny rule when any of them is or
+// the hostname does not resolve.
+func (r *EgressRule) match(t *egressTarget, deny bool) bool {
+	if len(r.Methods) > 0 && !containsString(r.Methods, t.method) {
+		return false
+	}
+	if r.Scheme != "" && r.Scheme != t.scheme {
+		return false
+	}
+	if r.Path != "" && !matchPathPrefix(t.path, r.Path) {
+		return false
+	}
+	return r.matchAddress(t, deny)
+}
+
+// matchAddress is match for the host and port alone.
+func (r *EgressRule) matchAddress(t *egressTarget, deny bool) bool {
+	if r.Port != 0 && r.Port != t.port {
+		return false
+	}
+
+	switch {
+	case r.Network != nil:
+		addrs := t.resolve()
+		if len(addrs) == 0 {
+			// Unresolved hosts may be in range: deny rules fail closed.
+			return deny
+		}
+		for _, ip := range addrs {
+			if r.Network.Contains(ip) == deny {
+				return deny
+			}
+		}
+		return !deny
+	case r.Host == "*":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(t.host, r.Host[1:])
+	default:
+		return r.Host == t.host
+	}
+}
+
+func matchPathPrefix(path, prefix string) bool {
+	if path == "" {
+		path = "/"
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// EgressPolicy decides which upstream requests a side of the tunnel performs.
+// Deny rules are evaluated first; when allow rules are configured a request
+// must match one of them.
+type EgressPolicy struct {
+	Allow []EgressRule
+	Deny  []EgressRule
+}
+
+func NewEgressPolicy(allow, deny []string) (*EgressPolicy, error) {
+	policy := &EgressPolicy{}
+	for _, entry := range allow {
+		rule, err := ParseEgressRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("WHITE_LIST: %w", err)
+		}
+		policy.Allow = append(policy.Allow, rule)
+	}
+	for _, entry := range deny {
+		rule, err := ParseEgressRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("DENY_LIST: %w", err)
+		}
+		policy.Deny = append(policy.Deny, rule)
+	}
+	return policy, nil
+}
+
+// Check returns an error when the policy does not allow req.
+func (p *EgressPolicy) Check(req *HttpRequestMessage) error {
+	if len(p.Allow) == 0 && len(p.Deny) == 0 {
+		return nil
+	}
+	t, err := newEgressTarget(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRequestNotAllowed, err)
+	}
+	for i := range p.Deny {
+		if p.Deny[i].match(t, true) {
+			return fmt.Errorf("%w for host: %s", ErrRequestNotAllowed, t.host)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for i := range p.Allow {
+		if p.Allow[i].match(t, false) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w for host: %s", ErrRequestNotAllowed, t.host)
+}
+
+// CheckDial applies the policy to the addresses the dialer connects to for
+// host. Check resolves the host on its own, which a name can answer
+// differently, so the address rules are checked again here. The method,
+// scheme and path are not known when dialing: deny rules for addresses
+// apply whatever they are limited to, allow rules as if they matched.
+func (p *EgressPolicy) CheckDial(host string, port int, addrs []net.IP) error {
+	if p == nil || len(p.Allow) == 0 && len(p.Deny) == 0 {
+		return nil
+	}
+	t := &egressTarget{host: strings.ToLower(strings.TrimSuffix(host, ".")), port: port, addrs: addrs}
+	for i := range p.Deny {
+		if p.Deny[i].Network != nil && p.Deny[i].matchAddress(t, true) {
+			return fmt.Errorf("%w for address of host: %s", ErrRequestNotAllowed, t.host)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for i := range p.Allow {
+		if p.Allow[i].matchAddress(t, false) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w for address of host: %s", ErrRequestNotAllowed, t.host)
+}
+
+var policies sync.Map // *config.Config -> *EgressPolicy
+
+// policyFor returns the egress policy of a config, parsed once.
+func policyFor(cfg *config.Config) (*EgressPolicy, error) {
+	if policy, ok := policies.Load(cfg); ok {
+		return policy.(*EgressPolicy), nil
+	}
+	policy, err := NewEgressPolicy(cfg.WHITE_LIST, cfg.DENY_LIST)
+	if err != nil {
+		return nil, err
+	}
+	policies.Store(cfg, policy)
+	return policy, nil
+}
@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/niradler/go-netbridge/tunnel"
+	"go.uber.org/zap"
+)
+
+var ErrUnknownService = errors.New("unknown service")
+
+// publishedServices returns the service names a client announced on the
+// handshake. Invalid names are dropped.
+func publishedServices(r *http.Request) []string {
+	var services []string
+	for _, name := range strings.Split(r.Header.Get(tunnel.PublishHeader), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !ValidClientName(name) {
+			GetLogger().Warn("Ignoring invalid service name", zap.String("service", name))
+			continue
+		}
+		services = append(services, name)
+	}
+	return services
+}
+
+// RouteService matches a request to a published service, either by hostname,
+// "<service>.<domain>" when domain is set, or by the first path segment,
+// "/<service>/...". Requests naming a client in X-Tunnel-Client are left to
+// client routing, and a service never shadows a connected client of the same
+// name. The returned path has a matched service prefix removed.
+func (cr *ClientRegistry) RouteService(r *http.Request, domain string) (*WebSocketServer, string, string, bool) {
+	if r.Header.Get(TunnelClientHeader) != "" {
+		return nil, "", "", false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if domain != "" && net.ParseIP(host) == nil {
+		label, rest, found := strings.Cut(host, ".")
+		if found && strings.EqualFold(rest, domain) {
+			if wss, ok := cr.routableService(label); ok {
+				return wss, label, r.URL.Path, true
+			}
+		}
+	}
+
+	segment, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if segment != "" {
+		if wss, ok := cr.routableService(segment); ok {
+			return wss, segment, "/" + rest, true
+		}
+	}
+	return nil, "", "", false
+}
+
+func (cr *ClientRegistry) routableService(name string) (*WebSocketServer, bool) {
+	if _, ok := cr.Get(name); ok {
+		return nil, false
+	}
+	return cr.Service(name)
+}
+
+// resolveService points a request for a published service at its local
+// target from PUBLISH. Only the path and query are taken from the peer.
+func resolveService(req *HttpRequestMessage, cfg *config.Config) error {
+	target, ok := cfg.PUBLISH[req.Service]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownService, req.Service)
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	base, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target for service %s: %w", req.Service, err)
+	}
+	ref, err := url.ParseRequestURI(req.URL)
+	if err != nil {
+		return fmt.Errorf("invalid request URL %q: %w", req.URL, err)
+	}
+
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + ref.Path
+	u.RawPath = ""
+	u.RawQuery = ref.RawQuery
+	req.URL = u.String()
+	req.trusted = true
+	return nil
+}
+
+// proxyService relays a public request to the client publishing service.
+func (hs *HTTPServer) proxyService(w http.ResponseWriter, r *http.Request, wss *WebSocketServer, service, path string) {
+	if path == "" {
+		path = "/"
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	headers := getReqHeaders(r.Header)
+	headers.Set("X-Forwarded-Host", r.Host)
+	headers.Set("X-Forwarded-Proto", proto)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := headers.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		headers.Set("X-Forwarded-For", ip)
+	}
+
+	u := url.URL{Path: path, RawQuery: r.URL.RawQuery}
+	hs.proxyTunnel(w, r, wss, &HttpRequestMessage{
+		Method:  r.Method,
+		URL:     u.String(),
+		Headers: headers,
+		Service: service,
+	})
+}
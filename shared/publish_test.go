@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteService(t *testing.T) {
+	cr := NewClientRegistry()
+	cr.Register(&WebSocketServer{Name: "site1", Services: []string{"app1"}})
+	if _, conflicts := cr.Register(&WebSocketServer{Name: "site2", Services: []string{"site1", "app1", "app2"}}); len(conflicts) != 2 {
+		t.Errorf("Register conflicts = %v, want [site1 app1]", conflicts)
+	}
+	// A client connecting later under a published name takes its routes back.
+	cr.Register(&WebSocketServer{Name: "app2"})
+
+	tests := []struct {
+		name    string
+		host    string
+		path    string
+		header  string
+		domain  string
+		service string
+		rest    string
+	}{
+		{"host", "app1.tunnel.example.com", "/x", "", "tunnel.example.com", "app1", "/x"},
+		{"host with port", "app1.tunnel.example.com:8080", "/x", "", "tunnel.example.com", "app1", "/x"},
+		{"host outside the domain", "app1.evil.com", "/x", "", "tunnel.example.com", "", ""},
+		{"host without a domain", "app1.tunnel.example.com", "/x", "", "", "", ""},
+		{"path", "tunnel.example.com", "/app1/api", "", "", "app1", "/api"},
+		{"client header wins", "app1.tunnel.example.com", "/app1/api", "site1", "tunnel.example.com", "", ""},
+		{"client name", "tunnel.example.com", "/app2/api", "", "", "", ""},
+		{"unknown", "tunnel.example.com", "/other", "", "tunnel.example.com", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			if tt.header != "" {
+				r.Header.Set(TunnelClientHeader, tt.header)
+			}
+			wss, service, rest, ok := cr.RouteService(r, tt.domain)
+			if tt.service == "" {
+				if ok {
+					t.Errorf("RouteService routed to %q, want no service", service)
+				}
+				return
+			}
+			if !ok || service != tt.service || rest != tt.rest || wss.Name != "site1" {
+				t.Errorf("RouteService = %v %q %q %v, want site1 %q %q", wss, service, rest, ok, tt.service, tt.rest)
+			}
+		})
+	}
+}
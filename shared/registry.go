@@ -0,0 +1,192 @@
+package shared
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClientName  = "default"
+	TunnelClientHeader = "X-Tunnel-Client"
+)
+
+var clientNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,62}$`)
+
+// ValidClientName reports whether name can be used as a tunnel client identity.
+func ValidClientName(name string) bool {
+	return clientNamePattern.MatchString(name)
+}
+
+type ClientInfo struct {
+	Name           string    `json:"name"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	ActiveRequests int64     `json:"activeRequests"`
+	QueuedRequests int64     `json:"queuedRequests"`
+	Services       []string  `json:"services,omitempty"`
+	Version        string    `json:"version"`
+	Protocol       int       `json:"protocol"`
+	Features       []string  `json:"features"`
+	RTT            float64   `json:"rttMs,omitempty"` // latest heartbeat round trip
+}
+
+// ClientRegistry holds the tunnel clients connected to the server, keyed by
+// client name, and the services they publish, keyed by service name.
+type ClientRegistry struct {
+	mu       sync.RWMutex
+	clients  map[string]*WebSocketServer
+	services map[string]*WebSocketServer
+}
+
+func NewClientRegistry() *ClientRegistry {
+	return &ClientRegistry{
+		clients:  make(map[string]*WebSocketServer),
+		services: make(map[string]*WebSocketServer),
+	}
+}
+
+// Register adds a client and returns the connection it replaced, if any, and
+// the services it announced that another client already publishes or that
+// are named like a connected client. A service stays with the client that
+// published it first until that client disconnects; the conflicting ones are
+// dropped from wss.Services.
+func (cr *ClientRegistry) Register(wss *WebSocketServer) (*WebSocketServer, []string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	previous := cr.clients[wss.Name]
+	cr.clients[wss.Name] = wss
+	var services, conflicts []string
+	for _, service := range wss.Services {
+		if _, ok := cr.clients[service]; ok {
+			conflicts = append(conflicts, service)
+			continue
+		}
+		if owner, ok := cr.services[service]; ok && owner.Name != wss.Name {
+			conflicts = append(conflicts, service)
+			continue
+		}
+		cr.services[service] = wss
+		services = append(services, service)
+	}
+	wss.Services = services
+	return previous, conflicts
+}
+
+// Unregister removes a client, unless it has already been replaced by a newer connection.
+func (cr *ClientRegistry) Unregister(wss *WebSocketServer) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.clients[wss.Name] == wss {
+		delete(cr.clients, wss.Name)
+	}
+	for service, owner := range cr.services {
+		if owner == wss {
+			delete(cr.services, service)
+		}
+	}
+}
+
+// Service returns the client publishing service.
+func (cr *ClientRegistry) Service(service string) (*WebSocketServer, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	wss, ok := cr.services[service]
+	return wss, ok
+}
+
+func (cr *ClientRegistry) Get(name string) (*WebSocketServer, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	wss, ok := cr.clients[name]
+	return wss, ok
+}
+
+func (cr *ClientRegistry) Len() int {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return len(cr.clients)
+}
+
+// Connections returns the connections of all clients.
+func (cr *ClientRegistry) Connections() []*WebSocketServer {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	list := make([]*WebSocketServer, 0, len(cr.clients))
+	for _, wss := range cr.clients {
+		list = append(list, wss)
+	}
+	return list
+}
+
+// List returns the connected clients sorted by name.
+func (cr *ClientRegistry) List() []ClientInfo {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	list := make([]ClientInfo, 0, len(cr.clients))
+	for _, wss := range cr.clients {
+		list = append(list, ClientInfo{
+			Name:           wss.Name,
+			RemoteAddr:     wss.RemoteAddr,
+			ConnectedAt:    wss.ConnectedAt,
+			ActiveRequests: wss.active.Load(),
+			QueuedRequests: wss.queued.Load(),
+			Services:       wss.Services,
+			Version:        wss.peer.Version,
+			Protocol:       wss.protocol,
+			Features:       wss.peer.Features,
+			RTT:            float64(wss.RTT().Microseconds()) / 1000,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Route picks the client for an incoming request. Clients are matched by the
+// X-Tunnel-Client header, then by the first label of the hostname, then by the
+// first path segment. When only one client is connected it receives everything
+// else. The returned path has a matched client prefix removed.
+func (cr *ClientRegistry) Route(r *http.Request) (*WebSocketServer, string, bool) {
+	path := r.URL.Path
+
+	if name := r.Header.Get(TunnelClientHeader); name != "" {
+		wss, ok := cr.Get(name)
+		return wss, path, ok
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if label, _, found := strings.Cut(host, "."); found && net.ParseIP(host) == nil {
+		if wss, ok := cr.Get(label); ok {
+			return wss, path, true
+		}
+	}
+
+	segment, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if segment != "" {
+		if wss, ok := cr.Get(segment); ok {
+			return wss, "/" + rest, true
+		}
+	}
+
+	wss, ok := cr.sole()
+	return wss, path, ok
+}
+
+// sole returns the connected client when exactly one is connected.
+func (cr *ClientRegistry) sole() (*WebSocketServer, bool) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	if len(cr.clients) == 1 {
+		for _, wss := range cr.clients {
+			return wss, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientRegistryRoute(t *testing.T) {
+	cr := NewClientRegistry()
+	site1 := &WebSocketServer{Name: "site1"}
+	site2 := &WebSocketServer{Name: "site2"}
+	cr.Register(site1)
+	cr.Register(site2)
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		header string
+		want   *WebSocketServer
+		rest   string
+	}{
+		{"header", "site1.tunnel.example.com", "/site1/api", "site2", site2, "/site1/api"},
+		{"unknown header", "site1.tunnel.example.com", "/api", "site3", nil, ""},
+		{"host", "site2.tunnel.example.com", "/api", "", site2, "/api"},
+		{"host with port", "site2.tunnel.example.com:8080", "/api", "", site2, "/api"},
+		{"host before path", "site2.tunnel.example.com", "/site1/api", "", site2, "/site1/api"},
+		{"IP host", "127.0.0.1", "/site1/api", "", site1, "/api"},
+		{"path", "tunnel.example.com", "/site1/api", "", site1, "/api"},
+		{"path root", "tunnel.example.com", "/site1", "", site1, "/"},
+		{"no match", "tunnel.example.com", "/api", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			if tt.header != "" {
+				r.Header.Set(TunnelClientHeader, tt.header)
+			}
+			wss, rest, ok := cr.Route(r)
+			if tt.want == nil {
+				if ok {
+					t.Errorf("Route = %s, want no client", wss.Name)
+				}
+				return
+			}
+			if !ok || wss != tt.want || rest != tt.rest {
+				t.Errorf("Route = %v %q %v, want %s %q", wss, rest, ok, tt.want.Name, tt.rest)
+			}
+		})
+	}
+
+	// A single client receives everything else.
+	cr.Unregister(site2)
+	r := httptest.NewRequest("GET", "/api", nil)
+	if wss, rest, ok := cr.Route(r); !ok || wss != site1 || rest != "/api" {
+		t.Errorf("Route with one client = %v %q %v, want site1", wss, rest, ok)
+	}
+}
+
+func TestClientRegistryReplace(t *testing.T) {
+	cr := NewClientRegistry()
+	old := &WebSocketServer{Name: "site1", Services: []string{"app"}}
+	cr.Register(old)
+	current := &WebSocketServer{Name: "site1", Services: []string{"app"}}
+	if previous, conflicts := cr.Register(current); previous != old || len(conflicts) != 0 {
+		t.Errorf("Register = %v %v, want the old connection and no conflicts", previous, conflicts)
+	}
+
+	// The replaced connection going away leaves the new one in place.
+	cr.Unregister(old)
+	if wss, ok := cr.Get("site1"); !ok || wss != current {
+		t.Error("Unregister of a replaced connection removed its successor")
+	}
+	if wss, ok := cr.Service("app"); !ok || wss != current {
+		t.Error("Unregister of a replaced connection removed its successor's service")
+	}
+	cr.Unregister(current)
+	if cr.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", cr.Len())
+	}
+}
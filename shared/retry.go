@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/valyala/fasthttp"
+)
+
+// retryReserve is the number of retries the budget allows before any
+// requests have paid into it.
+const retryReserve = 10
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// RetryPolicy decides whether a failed upstream request is attempted again.
+type RetryPolicy struct {
+	Attempts  int
+	Statuses  map[int]bool
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	budget    *retryBudget
+}
+
+func NewRetryPolicy(cfg *config.Config) *RetryPolicy {
+	p := &RetryPolicy{
+		Attempts:  cfg.RETRY_ATTEMPTS,
+		Statuses:  make(map[int]bool),
+		BaseDelay: cfg.RETRY_BASE_DELAY,
+		MaxDelay:  cfg.RETRY_MAX_DELAY,
+	}
+	if cfg.RETRY_BUDGET > 0 {
+		p.budget = &retryBudget{ratio: float64(cfg.RETRY_BUDGET) / 100, tokens: retryReserve}
+	}
+	for _, status := range cfg.RETRY_STATUS {
+		if code, err := strconv.Atoi(strings.TrimSpace(status)); err == nil {
+			p.Statuses[code] = true
+		}
+	}
+	return p
+}
+
+// attempts returns how often a request may be attempted. Only requests that
+// are safe to repeat are retried: idempotent methods, or any method carrying
+// an Idempotency-Key.
+func (p *RetryPolicy) attempts(req *HttpRequestMessage) int {
+	if idempotentMethods[strings.ToUpper(req.Method)] || http.Header(req.Headers).Get("Idempotency-Key") != "" {
+		return p.Attempts
+	}
+	return 1
+}
+
+// retry reports whether the outcome of attempt n (from 0) is worth another
+// try and how long to wait first. Connection errors and the configured
+// statuses are retried; a Retry-After longer than MaxDelay is not waited for.
+func (p *RetryPolicy) retry(attempt int, err error, resp *fasthttp.Response) (time.Duration, bool) {
+	if err != nil {
+		if errors.Is(err, ErrBlockedAddress) || errors.Is(err, ErrRequestNotAllowed) {
+			return 0, false
+		}
+		return backoff(attempt, p.BaseDelay, p.MaxDelay), true
+	}
+	if !p.Statuses[resp.StatusCode()] {
+		return 0, false
+	}
+	if wait, ok := retryAfter(resp.Header.Peek("Retry-After")); ok {
+		return wait, wait <= p.MaxDelay
+	}
+	return backoff(attempt, p.BaseDelay, p.MaxDelay), true
+}
+
+// retryAfter parses a Retry-After value, either seconds or an HTTP date.
+func retryAfter(value []byte) (time.Duration, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(string(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(string(value)); err == nil {
+		wait := time.Until(at)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// retryBudget limits retries to a share of requests, so retries cannot
+// multiply the load on an upstream that is already failing. Every request
+// pays ratio into the budget and every retry takes one out. A nil budget
+// allows any number of retries.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > retryReserve {
+		b.tokens = retryReserve
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var retryPolicies sync.Map // *config.Config -> *RetryPolicy
+
+// retryPolicyFor returns the retry policy of a config, created once.
+func retryPolicyFor(cfg *config.Config) *RetryPolicy {
+	if p, ok := retryPolicies.Load(cfg); ok {
+		return p.(*RetryPolicy)
+	}
+	p, _ := retryPolicies.LoadOrStore(cfg, NewRetryPolicy(cfg))
+	return p.(*RetryPolicy)
+}
@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	p := NewRetryPolicy(&config.Config{RETRY_ATTEMPTS: 3})
+	tests := []struct {
+		method  string
+		headers map[string][]string
+		want    int
+	}{
+		{"GET", nil, 3},
+		{"delete", nil, 3},
+		{"POST", nil, 1},
+		{"PATCH", nil, 1},
+		{"POST", map[string][]string{"Idempotency-Key": {"abc"}}, 3},
+	}
+	for _, tt := range tests {
+		if got := p.attempts(&HttpRequestMessage{Method: tt.method, Headers: tt.headers}); got != tt.want {
+			t.Errorf("attempts(%s %v) = %d, want %d", tt.method, tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter([]byte(tt.value))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v %v, want %v %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// An HTTP date in the future waits until then.
+	got, ok := retryAfter([]byte(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)))
+	if !ok || got <= 50*time.Second || got > time.Minute {
+		t.Errorf("retryAfter(date in a minute) = %v %v", got, ok)
+	}
+}
+
+func TestRetryPolicyRetry(t *testing.T) {
+	p := NewRetryPolicy(&config.Config{RETRY_ATTEMPTS: 3, RETRY_STATUS: []string{"503"}, RETRY_BASE_DELAY: time.Millisecond, RETRY_MAX_DELAY: time.Second})
+	response := func(status int, retryAfter string) *fasthttp.Response {
+		resp := &fasthttp.Response{}
+		resp.SetStatusCode(status)
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	if _, ok := p.retry(0, errors.New("connection refused"), nil); !ok {
+		t.Error("connection error not retried")
+	}
+	if _, ok := p.retry(0, ErrBlockedAddress, nil); ok {
+		t.Error("blocked address retried")
+	}
+	if _, ok := p.retry(0, nil, response(500, "")); ok {
+		t.Error("status outside RETRY_STATUS retried")
+	}
+	if _, ok := p.retry(0, nil, response(503, "")); !ok {
+		t.Error("503 not retried")
+	}
+	if wait, ok := p.retry(0, nil, response(503, "1")); !ok || wait != time.Second {
+		t.Errorf("503 with Retry-After: 1 = %v %v, want 1s", wait, ok)
+	}
+	if _, ok := p.retry(0, nil, response(503, "60")); ok {
+		t.Error("503 with a Retry-After above RETRY_MAX_DELAY retried")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{ratio: 0.5, tokens: 2}
+	if !b.withdraw() || !b.withdraw() {
+		t.Fatal("budget refused its reserve")
+	}
+	if b.withdraw() {
+		t.Fatal("exhausted budget allowed a retry")
+	}
+	b.deposit()
+	if b.withdraw() {
+		t.Error("half a token allowed a retry")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Error("budget refused a retry paid for by two requests")
+	}
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	if b.tokens != retryReserve {
+		t.Errorf("budget grew to %v, want at most %d", b.tokens, retryReserve)
+	}
+
+	var unlimited *retryBudget
+	if !unlimited.withdraw() {
+		t.Error("nil budget refused a retry")
+	}
+}
+
+func TestRetriesUpstream(t *testing.T) {
+	InitLogger(config.Config{})
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		budget  int
+		method  string
+		headers map[string][]string
+		hits    int32
+	}{
+		{"GET", -1, "GET", nil, 3},
+		{"POST", -1, "POST", nil, 1},
+		{"POST with Idempotency-Key", -1, "POST", map[string][]string{"Idempotency-Key": {"abc"}}, 3},
+		{"exhausted budget", 1, "GET", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				ALLOW_PRIVATE_NETWORKS:   true,
+				REQUEST_TIMEOUT:          5 * time.Second,
+				UPSTREAM_MAX_BUFFER_SIZE: 1 << 20,
+				RETRY_ATTEMPTS:           3,
+				RETRY_STATUS:             []string{"503"},
+				RETRY_BASE_DELAY:         time.Millisecond,
+				RETRY_MAX_DELAY:          10 * time.Millisecond,
+				RETRY_BUDGET:             tt.budget,
+			}
+			if tt.budget > 0 {
+				// As if the reserve had been used up by earlier requests.
+				retryPolicyFor(cfg).budget.tokens = 0
+			}
+			hits.Store(0)
+			res, body, err := HttpRequestStream(&HttpRequestMessage{Method: tt.method, URL: upstream.URL, Headers: tt.headers}, nil, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body.Close()
+			if res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status %d, want 503", res.StatusCode)
+			}
+			if got := hits.Load(); got != tt.hits {
+				t.Errorf("upstream hit %d times, want %d", got, tt.hits)
+			}
+		})
+	}
+}
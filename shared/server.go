@@ -1,120 +1,220 @@
 package shared
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/niradler/go-netbridge/config"
 	"github.com/niradler/go-netbridge/tunnel"
-	"github.com/niradler/socketflow"
 	"go.uber.org/zap"
 )
 
 type HTTPServer struct {
-	config *config.Config
-	wss    *socketflow.WebSocketClient
-	router *chi.Mux
+	config    *config.Config
+	tunnel    *WebSocketConnection
+	clients   *ClientRegistry
+	router    *chi.Mux
+	server    *http.Server
+	mu        sync.Mutex
+	listeners []net.Listener // TCP forwards
+	draining  atomic.Bool
 }
 
 func NewWebSocketServer(hs *HTTPServer) {
 	logger := GetLogger()
 	hs.router.Get("/_ws", func(w http.ResponseWriter, r *http.Request) {
-		client, err := tunnel.Create(w, r)
+		name, err := AuthenticateHandshake(r, hs.config)
 		if err != nil {
-			logger.Error("Error upgrading connection", zap.String("error", err.Error()))
+			logger.Warn("Rejected WebSocket connection", zap.String("client", name), zap.String("remoteAddr", r.RemoteAddr), zap.String("reason", err.Error()))
+			if handshakeStatus(err) == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="netbridge"`)
+			}
+			http.Error(w, err.Error(), handshakeStatus(err))
 			return
 		}
-		logger.Info("WebSocket connection established")
-		hs.wss = client
 
-		defer client.Close()
+		responseHeader := http.Header{}
+		responseHeader.Set(tunnel.HelloHeader, localHello(hs.config).String())
+		peer, protocol, err := greet(r.Header.Get(tunnel.HelloHeader))
+		if err != nil {
+			logger.Warn("Rejected WebSocket connection", zap.String("client", name), zap.String("remoteAddr", r.RemoteAddr), zap.String("reason", err.Error()))
+			w.Header().Set(tunnel.HelloHeader, responseHeader.Get(tunnel.HelloHeader))
+			http.Error(w, err.Error(), http.StatusUpgradeRequired)
+			return
+		}
 
-		go client.ReceiveMessages()
+		codec := negotiateCompression(r.Header.Get(tunnel.CompressionHeader), hs.config)
+		if codec != nil {
+			responseHeader.Set(tunnel.CompressionHeader, codec.name)
+		}
+		framing := negotiateFraming(r.Header.Get(tunnel.FramingHeader), hs.config)
+		responseHeader.Set(tunnel.FramingHeader, framing)
+		client, err := tunnel.Create(w, r, responseHeader)
+		if err != nil {
+			logger.Error("Error upgrading connection", zap.String("error", err.Error()))
+			return
+		}
+		logger.Info("WebSocket connection established", zap.String("client", name), zap.String("remoteAddr", r.RemoteAddr), zap.String("version", peer.Version), zap.Int("protocol", protocol), zap.String("publish", r.Header.Get(tunnel.PublishHeader)), zap.String("framing", framing))
+
+		wss := newWebSocketServer(client, hs.config)
+		wss.Name = name
+		wss.Services = publishedServices(r)
+		wss.peer, wss.protocol = peer, protocol
+		wss.codec = codec
+		wss.useFraming(framing)
+		wss.RemoteAddr = r.RemoteAddr
+		previous, conflicts := hs.clients.Register(wss)
+		if previous != nil {
+			logger.Warn("Replacing existing client connection", zap.String("client", name), zap.String("remoteAddr", previous.RemoteAddr))
+			previous.Client.Close()
+		}
+		for _, service := range conflicts {
+			logger.Warn("Ignoring service published by another client or named like one", zap.String("client", name), zap.String("service", service))
+		}
 
-		statusChan := client.SubscribeToStatus()
-		go func() {
-			for status := range statusChan {
-				logger.Debug("Received status", zap.Any("status", status))
-			}
-		}()
-
-		var wg sync.WaitGroup
-		wg.Add(1)
-
-		go func() {
-			defer wg.Done()
-			for msg := range client.Subscribe("request") {
-				logger.Debug("Received message", zap.String("message", string(msg.Payload)))
-				var req HttpRequestMessage
-				err := json.Unmarshal(msg.Payload, &req)
-				if err != nil {
-					logger.Error("Error parsing request message", zap.String("error", err.Error()))
-					continue
-				}
-				err = HttpRequestResponse(&req, hs.config, client)
-				if err != nil {
-					logger.Error("Error in http request", zap.String("error", err.Error()))
-					continue
-				}
-			}
-		}()
+		defer client.Close()
+		defer hs.clients.Unregister(wss)
 
-		wg.Wait()
+		wss.listen()
 
+		<-wss.Done()
+		logger.Info("WebSocket connection closed", zap.String("client", name))
 	})
 }
 
 // NewHTTPServer creates a new HTTPServer instance.
-func NewHTTPServer(config *config.Config, wss *socketflow.WebSocketClient) *HTTPServer {
+func NewHTTPServer(config *config.Config, tunnel *WebSocketConnection) *HTTPServer {
 	router := chi.NewRouter()
 	router.Use(middleware.Logger)
-
-	if config.SECRET != "" && config.Type != "client" {
-		router.Use(func(next http.Handler) http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				authHeader := r.Header.Get("X-Auth-SECRET")
-				if authHeader != config.SECRET {
-					http.Error(w, "Forbidden", http.StatusForbidden)
-					return
-				}
-				next.ServeHTTP(w, r)
-			})
-		})
-	}
 	hs := &HTTPServer{
-		wss:    wss,
-		router: router,
-		config: config,
+		tunnel:  tunnel,
+		clients: NewClientRegistry(),
+		router:  router,
+		config:  config,
+		server:  &http.Server{Addr: ":" + config.PORT, Handler: router},
 	}
 
-	router.Get("/_health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-		return
+	// The endpoints are protected by SECRET; the tunnel handshake on /_ws
+	// authenticates itself, see AuthenticateHandshake.
+	router.Group(func(router chi.Router) {
+		router.Use(hs.requireSecret)
+
+		router.Get("/_health", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			return
+		})
+
+		router.Get("/_tunnel", func(w http.ResponseWriter, r *http.Request) {
+			if hs.tunnel == nil {
+				http.Error(w, "Not a tunnel client", http.StatusNotFound)
+				return
+			}
+			status := hs.tunnel.Status()
+			w.Header().Set("Content-Type", "application/json")
+			if hs.tunnel.State() != StateConnected {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(status)
+		})
+
+		router.Get("/_clients", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(hs.clients.List())
+		})
+
+		router.Get("/_upstreams", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(upstreamPoolFor(hs.config).Stats())
+		})
+
+		router.Get("/_metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			hs.writeMetrics(w)
+		})
 	})
 
-	router.NotFound(hs.proxyHandler)
+	router.NotFound(hs.instrument(hs.proxyHandler))
 
 	return hs
 }
 
+// authorized reports whether r carries SECRET in X-Auth-SECRET, when the
+// server requires it.
+func (hs *HTTPServer) authorized(r *http.Request) bool {
+	if hs.config.SECRET == "" || hs.config.Type == "client" {
+		return true
+	}
+	return tokenEqual(r.Header.Get("X-Auth-SECRET"), hs.config.SECRET)
+}
+
+func (hs *HTTPServer) requireSecret(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hs.authorized(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Start starts the HTTP server on the specified port.
 func (hs *HTTPServer) Start() error {
 	logger := GetLogger()
+	if _, err := policyFor(hs.config); err != nil {
+		return err
+	}
+	if _, err := dialerFor(&HttpRequestMessage{}, hs.config); err != nil {
+		return err
+	}
+	if _, err := upstreamTLSFor(hs.config); err != nil {
+		return err
+	}
+	if _, err := routeTimeoutsFor(hs.config); err != nil {
+		return err
+	}
+	upstreamPoolFor(hs.config)
+	if err := hs.startTCPForwards(); err != nil {
+		return err
+	}
+
+	server := hs.server
 	if hs.config.SSL_CERT_FILE != "" && hs.config.SSL_KEY_FILE != "" {
-		logger.Debug("Starting HTTPS server", zap.String("port", hs.config.PORT))
-		return http.ListenAndServeTLS(":"+hs.config.PORT, hs.config.SSL_CERT_FILE, hs.config.SSL_KEY_FILE, hs.router)
+		if hs.config.CLIENT_CA_FILE != "" {
+			pool, err := tunnel.LoadCertPool(hs.config.CLIENT_CA_FILE)
+			if err != nil {
+				return err
+			}
+			// Certificates are verified whenever presented; only the tunnel
+			// handshake requires one, see AuthenticateHandshake.
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.VerifyClientCertIfGiven,
+				MinVersion: tls.VersionTLS12,
+			}
+		}
+		logger.Debug("Starting HTTPS server", zap.String("port", hs.config.PORT), zap.Bool("mtls", hs.config.CLIENT_CA_FILE != ""))
+		return server.ListenAndServeTLS(hs.config.SSL_CERT_FILE, hs.config.SSL_KEY_FILE)
+	}
+	if hs.config.CLIENT_CA_FILE != "" {
+		return fmt.Errorf("CLIENT_CA_FILE requires SSL_CERT_FILE and SSL_KEY_FILE")
 	}
 
 	logger.Info("Starting HTTP server", zap.String("port", hs.config.PORT))
-	return http.ListenAndServe(":"+hs.config.PORT, hs.router)
+	return server.ListenAndServe()
 }
 
 var IgnoredHeaders = map[string]struct{}{
@@ -150,30 +250,100 @@ func getReqHeaders(headers http.Header) http.Header {
 	reqHeaders.Del("X-Forwarded-Host")
 	reqHeaders.Del("X-Auth-SECRET")
 	reqHeaders.Del("X-Proxy-Type")
+	reqHeaders.Del(TunnelClientHeader)
 
 	return reqHeaders
 }
 
+// requestBody returns the body of r, or nil when it has none.
+func requestBody(r *http.Request) io.Reader {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	return r.Body
+}
+
+// writeResponse copies a response head and streamed body to the caller.
+func writeResponse(w http.ResponseWriter, res *HttpResponseMessage, body io.Reader) {
+	for key, value := range getResHeaders(res.Headers) {
+		w.Header().Set(key, strings.Join(value, ","))
+	}
+
+	var dst io.Writer = w
+	if isIncrementalResponse(res.Headers) {
+		dst = newFlushWriter(w)
+	}
+
+	w.WriteHeader(res.StatusCode)
+	_, err := io.CopyBuffer(dst, body, make([]byte, streamFrameSize))
+	if err != nil {
+		logger.Error("Error writing response body", zap.String("error", err.Error()))
+	}
+}
+
+// writeTunnelError answers the caller when a request could not be completed through the tunnel.
+func writeTunnelError(w http.ResponseWriter, req *HttpRequestMessage, err error) {
+	logger.Error("Error in tunnel request", zap.String("id", req.ID), zap.String("error", err.Error()))
+	switch {
+	case errors.Is(err, ErrRequestTimeout), errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, ErrTunnelClosed):
+		http.Error(w, "Tunnel connection lost", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrTunnelDraining):
+		http.Error(w, "Tunnel is shutting down", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Failed to send message", http.StatusBadGateway)
+	}
+}
+
 func (hs *HTTPServer) proxyRequest(w http.ResponseWriter, r *http.Request, req HttpRequestMessage) {
 	logger.Debug("Received request", zap.String("method", r.Method), zap.String("url", r.URL.String()))
-	res, err := HttpRequest(&req, hs.config)
+	req.deadline = time.Now().Add(hs.routeTimeout(r))
+	if isUpgradeRequest(r) {
+		hs.proxyUpgradeDirect(w, &req)
+		return
+	}
+	req.cancel = r.Context().Done()
+	req.span = spanFromContext(r.Context())
+	res, body, err := HttpRequestStream(&req, requestBody(r), hs.config)
 	if err != nil {
 		logger.Error("Error HttpRequest", zap.Error(err))
+		if errors.Is(err, ErrRequestCancelled) {
+			return
+		}
+		if isTimeout(err) {
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			return
+		}
 		http.Error(w, "Failed to do request", http.StatusInternalServerError)
 		return
 	}
-	for key, value := range getResHeaders(res.Headers) {
-		w.Header().Set(key, strings.Join(value, ","))
+	defer body.Close()
+
+	writeResponse(w, res, body)
+}
+
+// tunnelFor returns the tunnel connection a request should be sent through.
+// Clients use their own connection while it is up, the server routes between
+// registered clients.
+func (hs *HTTPServer) tunnelFor(r *http.Request) (*WebSocketServer, string, bool) {
+	if hs.tunnel != nil {
+		wss, ok := hs.tunnel.Connection()
+		return wss, r.URL.Path, ok
 	}
+	return hs.clients.Route(r)
+}
 
-	w.WriteHeader(res.StatusCode)
-	_, err = w.Write(res.Body)
-	if err != nil {
-		logger.Error("Error Write", zap.Error(err))
-		http.Error(w, "Failed to Write Response", http.StatusInternalServerError)
-		return
+// tunnelByName returns the tunnel connection for a named client. An empty
+// name picks the only connected client.
+func (hs *HTTPServer) tunnelByName(name string) (*WebSocketServer, bool) {
+	if hs.tunnel != nil {
+		return hs.tunnel.Connection()
+	}
+	if name == "" {
+		return hs.clients.sole()
 	}
-	// io.Copy(w, res.Body)
+	return hs.clients.Get(name)
 }
 
 func (hs *HTTPServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
@@ -185,21 +355,16 @@ func (hs *HTTPServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: handle large request bodies, use config for chunk size
-	chunkSize := 1024 * 1024 // 1 MB chunks
-	buf := make([]byte, chunkSize)
-	var payload []byte
+	if wss, service, path, ok := hs.clients.RouteService(r, hs.config.PUBLIC_DOMAIN); ok {
+		hs.proxyService(w, r, wss, service, path)
+		return
+	}
 
-	for {
-		n, err := r.Body.Read(buf)
-		if err != nil && err != io.EOF {
-			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-			return
-		}
-		if n == 0 {
-			break
-		}
-		payload = append(payload, buf[:n]...)
+	// Published services are public, like the local services behind them;
+	// everything else is protected by SECRET.
+	if !hs.authorized(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
 	host := hs.config.X_Forwarded_Host
@@ -242,7 +407,7 @@ func (hs *HTTPServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 			Method:  r.Method,
 			URL:     serverUrl.String(),
 			Headers: reqHeaders,
-			Body:    payload,
+			trusted: true,
 		})
 	} else if proxyType == "proxy" {
 		hostUrl := url.URL{Scheme: r.Header.Get("X-Forwarded-Proto"), Host: r.Header.Get("X-Forwarded-Host"), Path: r.URL.Path, RawQuery: r.URL.RawQuery}
@@ -250,7 +415,6 @@ func (hs *HTTPServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 			Method:  r.Method,
 			URL:     hostUrl.String(),
 			Headers: getReqHeaders(r.Header),
-			Body:    payload,
 		}
 		if err := RequestAllowed(&reqMsg, hs.config); err != nil {
 			http.Error(w, fmt.Sprintf("Request not allowed for host: %s", host), http.StatusForbidden)
@@ -258,53 +422,48 @@ func (hs *HTTPServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		hs.proxyRequest(w, r, reqMsg)
 	} else {
-		u := url.URL{Scheme: proto, Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
-		reqMsg := HttpRequestMessage{
-			Method:  r.Method,
-			URL:     u.String(),
-			Headers: getReqHeaders(r.Header),
-			Body:    payload,
-		}
-		payload, err := json.Marshal(reqMsg)
-		if err != nil {
-			logger.Error("Error marshaling request", zap.String("error", err.Error()))
-			http.Error(w, "Failed to marshal request", http.StatusInternalServerError)
+		wss, path, ok := hs.tunnelFor(r)
+		if !ok {
+			logger.Error("No tunnel connection", zap.String("client", r.Header.Get(TunnelClientHeader)))
+			http.Error(w, "No tunnel connection", http.StatusServiceUnavailable)
 			return
 		}
 
-		id, err := hs.wss.SendMessage("request", payload)
-		if err != nil {
-			logger.Error("Error writing message", zap.String("error", err.Error()))
-			http.Error(w, "Failed to send message", http.StatusInternalServerError)
-			return
-		}
-		logger.Debug("Sent message with ID", zap.String("id", id))
+		u := url.URL{Scheme: proto, Host: host, Path: path, RawQuery: r.URL.RawQuery}
+		hs.proxyTunnel(w, r, wss, &HttpRequestMessage{
+			Method:  r.Method,
+			URL:     u.String(),
+			Headers: getReqHeaders(r.Header),
+		})
+	}
 
-		select {
-		case responseMessage := <-hs.wss.Subscribe("response"):
-			logger.Debug("Response message", zap.String("id", responseMessage.ID), zap.Bool("isChunk", responseMessage.IsChunk))
-			var response HttpResponseMessage
-			err := json.Unmarshal(responseMessage.Payload, &response)
-			if err != nil {
-				logger.Error("Error unmarshalling response", zap.String("error", err.Error()))
-				http.Error(w, "Failed to parse response", http.StatusInternalServerError)
-				return
-			}
-			for key, value := range getResHeaders(response.Headers) {
-				w.Header().Set(key, strings.Join(value, ","))
-			}
+}
 
-			w.WriteHeader(response.StatusCode)
+// proxyTunnel sends a request through wss and relays the response to the caller.
+func (hs *HTTPServer) proxyTunnel(w http.ResponseWriter, r *http.Request, wss *WebSocketServer, reqMsg *HttpRequestMessage) {
+	if isUpgradeRequest(r) {
+		hs.proxyUpgrade(w, r, wss, reqMsg)
+		return
+	}
 
-			_, err = w.Write(response.Body)
-			if err != nil {
-				logger.Error("Error writing chunk to response", zap.String("error", err.Error()))
-				return
-			}
-			w.(http.Flusher).Flush() // Flush the response to the client
-		case <-r.Context().Done():
-			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
-		}
+	// The deadline only bounds the wait for the response head; the far side
+	// enforces it on the whole upstream exchange.
+	ctx, cancel := context.WithTimeout(r.Context(), hs.routeTimeout(r))
+	defer cancel()
+	span := spanFromContext(r.Context()).Child("tunnel "+r.Method, spanKindClient)
+	span.SetAttribute("netbridge.client", wss.Name)
+	if span != nil {
+		reqMsg.Trace = span.Context().TraceParent()
+	}
+	response, body, err := wss.Request(ctx, reqMsg, requestBody(r))
+	span.Fail(err)
+	span.End()
+	if err != nil {
+		writeTunnelError(w, reqMsg, err)
+		return
 	}
+	defer body.Close()
+	logger.Debug("Response message", zap.String("id", response.ID), zap.Bool("stream", response.Stream))
 
+	writeResponse(w, response, body)
 }
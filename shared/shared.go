@@ -1,19 +1,19 @@
 package shared
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"reflect"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/niradler/go-netbridge/config"
-	"github.com/niradler/socketflow"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
@@ -40,27 +40,41 @@ func ConvertHeadersMulti(headers http.Header) map[string]string {
 	return converted
 }
 
-func Ping(client *socketflow.WebSocketClient) error {
-	for i := 1; i <= 3; i++ {
-		_, err := client.SendMessage("ping", []byte("ping"))
-		if err != nil {
-			return err
-		}
+// NewMessageID returns a random ID used to correlate tunnel messages.
+func NewMessageID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Failed to generate message ID: " + err.Error())
 	}
-	return nil
+	return hex.EncodeToString(buf)
 }
 
 type HttpRequestMessage struct {
-	Method  string              `json:"method"`
-	URL     string              `json:"url"`
-	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
+	ID       string              `json:"id"`
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Headers  map[string][]string `json:"headers"`
+	Body     []byte              `json:"body,omitempty"`
+	Stream   bool                `json:"stream,omitempty"`      // body follows as stream frames
+	Upgrade  bool                `json:"upgrade,omitempty"`     // switch protocols and relay the raw connection
+	Service  string              `json:"service,omitempty"`     // published service the relative URL belongs to
+	Timeout  int64               `json:"timeoutMs,omitempty"`   // milliseconds the caller still waits when sent
+	Trace    string              `json:"traceparent,omitempty"` // W3C trace context of the sending hop
+	Encoding string              `json:"encoding,omitempty"`    // codec Body is compressed with
+
+	trusted  bool            // URL comes from this side's own configuration
+	deadline time.Time       // the upstream exchange is abandoned after this
+	cancel   <-chan struct{} // closed when the caller gives up
+	span     *Span           // the hop handling the request, nil when not traced
 }
 
 type HttpResponseMessage struct {
+	ID         string              `json:"id"`
 	StatusCode int                 `json:"statusCode"`
 	Headers    map[string][]string `json:"headers"`
-	Body       []byte              `json:"body"`
+	Body       []byte              `json:"body,omitempty"`
+	Stream     bool                `json:"stream,omitempty"`   // body follows as stream frames
+	Encoding   string              `json:"encoding,omitempty"` // codec Body is compressed with
 }
 
 type HttpResponse struct {
@@ -70,22 +84,18 @@ type HttpResponse struct {
 }
 
 func RequestAllowed(requestParams *HttpRequestMessage, config *config.Config) error {
-	if len(config.WHITE_LIST) > 0 {
-		host, _ := ExtractHostname(requestParams.URL)
-		logger.Info("WHITE_LIST", zap.Any("white_list", config.WHITE_LIST), zap.String("host", host))
-		allowed := false
-		for _, listed := range config.WHITE_LIST {
-			if strings.HasPrefix(host, listed) {
-				allowed = true
-				break
-			}
-		}
-
-		if !allowed {
-			return fmt.Errorf("Request not allowed for host: %s", host)
-
-		}
-
+	// Trusted targets come from this side's configuration, not from the peer.
+	if requestParams.trusted {
+		return nil
+	}
+	policy, err := policyFor(config)
+	if err != nil {
+		return err
+	}
+	if err := policy.Check(requestParams); err != nil {
+		metrics.rejected("policy")
+		logger.Warn("Request rejected by egress policy", zap.String("method", requestParams.Method), zap.String("url", requestParams.URL), zap.String("reason", err.Error()))
+		return err
 	}
 	return nil
 }
@@ -98,14 +108,62 @@ func ExtractHostname(urlStr string) (string, error) {
 	return parsedURL.Host, nil
 }
 
+// upstreamBody streams an upstream response body and releases the fasthttp
+// request and response once closed.
+type upstreamBody struct {
+	io.Reader
+	req  *fasthttp.Request
+	resp *fasthttp.Response
+	eof  bool
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	if !b.eof {
+		// The rest of the body is still on the wire, so the connection
+		// cannot be reused.
+		b.resp.SetConnectionClose()
+	}
+	err := b.resp.CloseBodyStream()
+	fasthttp.ReleaseRequest(b.req)
+	fasthttp.ReleaseResponse(b.resp)
+	return err
+}
+
 func HttpRequest(requestParams *HttpRequestMessage, config *config.Config) (*HttpResponseMessage, error) {
+	res, body, err := HttpRequestStream(requestParams, nil, config)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	res.Body, err = io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// HttpRequestStream performs the upstream request, sending body when it is
+// not nil instead of requestParams.Body. The returned response has no Body;
+// it is read from the returned ReadCloser, which must be closed.
+func HttpRequestStream(requestParams *HttpRequestMessage, body io.Reader, config *config.Config) (*HttpResponseMessage, io.ReadCloser, error) {
 	logger := GetLogger()
-	logger.Info("HttpRequest", zap.String("Method", requestParams.Method), zap.String("URL", requestParams.URL), zap.Int("BodyLen", len(requestParams.Body)))
+	logger.Info("HttpRequest", zap.String("Method", requestParams.Method), zap.String("URL", requestParams.URL), zap.Int("BodyLen", len(requestParams.Body)), zap.Bool("Stream", body != nil))
 
 	req := fasthttp.AcquireRequest()
-	defer fasthttp.ReleaseRequest(req)
 	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(resp)
+	release := func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}
 
 	req.SetRequestURI(requestParams.URL)
 	req.Header.SetMethod(requestParams.Method)
@@ -114,50 +172,80 @@ func HttpRequest(requestParams *HttpRequestMessage, config *config.Config) (*Htt
 			req.Header.Add(key, v)
 		}
 	}
-	req.SetBodyRaw(requestParams.Body)
 
-	client := &fasthttp.Client{
-		ReadBufferSize:      16 * 1024,
-		WriteBufferSize:     16 * 1024,
-		MaxConnDuration:     30 * time.Minute,
-		MaxIdleConnDuration: 60 * time.Second,
-		ReadTimeout:         30 * time.Second, // Increased timeout
-		WriteTimeout:        30 * time.Second, // Increased timeout
+	retries := retryPolicyFor(config)
+	attempts := retries.attempts(requestParams)
+	if body != nil {
+		contentLength := -1
+		if values := requestParams.Headers["Content-Length"]; len(values) > 0 {
+			if n, err := strconv.Atoi(values[0]); err == nil {
+				contentLength = n
+			}
+		}
+		req.SetBodyStream(body, contentLength)
+		// A streamed body can only be sent once, so it is never retried.
+		attempts = 1
+	} else {
+		req.SetBodyRaw(requestParams.Body)
 	}
 
-	if config.REQUEST_CA_FILE != "" {
-		caCert, err := os.ReadFile(config.REQUEST_CA_FILE)
-		if err != nil {
-			logger.Error("Error reading CA file", zap.String("error", err.Error()))
-			return nil, err
-		}
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCert) {
-			logger.Error("Failed to append CA certs")
-			return nil, fmt.Errorf("failed to append CA certs")
-		}
-		client.TLSConfig = &tls.Config{
-			RootCAs: caCertPool,
-		}
+	pool := upstreamPoolFor(config)
+	if requestParams.deadline.IsZero() {
+		requestParams.deadline = time.Now().Add(config.REQUEST_TIMEOUT)
 	}
 
-	// Retry logic
-	maxRetries := 2
+	// A streamed body cannot be sent again to the next hop, and trusted
+	// targets get their redirects passed back like any reverse proxy.
+	followRedirects := body == nil && !requestParams.trusted
+
+	span := requestParams.span.Child("upstream "+requestParams.Method, spanKindClient)
+	defer span.End()
+	span.SetAttribute("http.request.method", requestParams.Method)
+	// Not url.full: the query may carry credentials.
+	if u, err := url.Parse(requestParams.URL); err == nil {
+		span.SetAttribute("url.scheme", u.Scheme)
+		span.SetAttribute("server.address", u.Host)
+		span.SetAttribute("url.path", u.Path)
+	}
+	if span != nil {
+		// The upstream continues the trace from this hop.
+		req.Header.Set("traceparent", span.Context().TraceParent())
+	}
+
+	retries.budget.deposit()
 	var err error
-	for i := 0; i < maxRetries; i++ {
-		logger.Debug("DoRedirects", zap.Int("attempt", i+1))
-		err = client.DoRedirects(req, resp, 10)
-		if err == nil {
-			break // Success, exit retry loop
+	if requestParams.cancel == nil {
+		err = doRetries(pool, retries, attempts, req, resp, requestParams, config, followRedirects)
+	} else {
+		result := make(chan error, 1)
+		go func() {
+			result <- doRetries(pool, retries, attempts, req, resp, requestParams, config, followRedirects)
+		}()
+		select {
+		case err = <-result:
+		case <-requestParams.cancel:
+			// fasthttp cannot interrupt a request in flight. It is waited for,
+			// bounded by its deadline, so the caller keeps its MAX_CONCURRENT
+			// slot while the upstream is busy, and its connection is closed
+			// instead of reused.
+			if <-result == nil {
+				resp.SetConnectionClose()
+				resp.CloseBodyStream()
+			}
+			release()
+			logger.Debug("Upstream request abandoned", zap.String("URL", requestParams.URL))
+			span.Fail(ErrRequestCancelled)
+			return nil, nil, ErrRequestCancelled
 		}
-		logger.Warn("Retrying request", zap.Int("attempt", i+1), zap.String("error", err.Error()))
-		time.Sleep(500 * time.Millisecond) // Add a delay between retries
 	}
 	if err != nil {
 		logger.Error("Error in request after retries", zap.String("error", err.Error()))
-		return nil, err
+		span.Fail(err)
+		release()
+		return nil, nil, err
 	}
 
+	span.SetAttribute("http.response.status_code", resp.StatusCode())
 	headers := make(map[string][]string)
 	resp.Header.VisitAll(func(key, value []byte) {
 		headers[string(key)] = append(headers[string(key)], string(value))
@@ -165,39 +253,168 @@ func HttpRequest(requestParams *HttpRequestMessage, config *config.Config) (*Htt
 
 	logger.Debug("HttpResponse", zap.Int("StatusCode", resp.StatusCode()), zap.String("Method", requestParams.Method), zap.String("URL", requestParams.URL))
 
+	bodyStream := resp.BodyStream()
+	if bodyStream == nil {
+		bodyStream = bytes.NewReader(resp.Body())
+	}
+
 	return &HttpResponseMessage{
 		StatusCode: resp.StatusCode(),
 		Headers:    headers,
-		Body:       resp.Body(), // Streamed body
-	}, nil
+	}, &upstreamBody{Reader: bodyStream, req: req, resp: resp}, nil
 }
 
-func HttpRequestResponse(requestParams *HttpRequestMessage, config *config.Config, wss *socketflow.WebSocketClient) error {
+// doRetries performs req with doRedirects, retrying as the retry policy allows
+// while the request has time left and its caller is still waiting.
+func doRetries(pool *UpstreamPool, retries *RetryPolicy, attempts int, req *fasthttp.Request, resp *fasthttp.Response, requestParams *HttpRequestMessage, config *config.Config, followRedirects bool) error {
+	for attempt := 0; ; attempt++ {
+		logger.Debug("DoRedirects", zap.Int("attempt", attempt+1))
+		err := doRedirects(pool, req, resp, requestParams, config, followRedirects)
+		wait, retry := retries.retry(attempt, err, resp)
+		if !retry || attempt+1 >= attempts || requestParams.cancelled() {
+			return err
+		}
+		if time.Now().Add(wait).After(requestParams.deadline) {
+			logger.Warn("No time left to retry", zap.String("URL", requestParams.URL))
+			return err
+		}
+		if !retries.budget.withdraw() {
+			logger.Warn("Retry budget exhausted", zap.String("URL", requestParams.URL))
+			return err
+		}
+		reason := "status " + strconv.Itoa(resp.StatusCode())
+		if err != nil {
+			reason = err.Error()
+		} else {
+			resp.CloseBodyStream()
+		}
+		logger.Warn("Retrying request", zap.Int("attempt", attempt+1), zap.Duration("wait", wait), zap.String("reason", reason))
+		if err := requestParams.sleep(wait); err != nil {
+			return err
+		}
+		req.SetRequestURI(requestParams.URL)
+	}
+}
+
+const maxRedirects = 10
+
+// doRedirects performs req, following up to maxRedirects redirects when follow
+// is set. Every hop is checked against the egress policy and goes through the
+// pooled client of its own destination, whose dial guard checks the addresses
+// it connects to.
+func doRedirects(pool *UpstreamPool, req *fasthttp.Request, resp *fasthttp.Response, requestParams *HttpRequestMessage, config *config.Config, follow bool) error {
+	for redirects := 0; ; redirects++ {
+		if err := pool.Do(req, resp, requestParams); err != nil {
+			return err
+		}
+		if !follow || !fasthttp.StatusCodeIsRedirect(resp.StatusCode()) {
+			return nil
+		}
+		if redirects == maxRedirects {
+			return fasthttp.ErrTooManyRedirects
+		}
+		location := resp.Header.Peek("Location")
+		if len(location) == 0 {
+			return fasthttp.ErrMissingLocation
+		}
+
+		uri := fasthttp.AcquireURI()
+		req.URI().CopyTo(uri)
+		uri.UpdateBytes(location)
+		uri.SetHash("") // fragments stay with the client, see newEgressTarget
+		next := uri.String()
+		fasthttp.ReleaseURI(uri)
+
+		hop := *requestParams
+		hop.URL = next
+		if err := RequestAllowed(&hop, config); err != nil {
+			return fmt.Errorf("redirect to %s: %w", next, err)
+		}
+		logger.Debug("Following redirect", zap.Int("status", resp.StatusCode()), zap.String("location", next))
+		resp.CloseBodyStream()
+		req.SetRequestURI(next)
+	}
+}
+
+func HttpRequestResponse(requestParams *HttpRequestMessage, config *config.Config, wss *WebSocketServer) error {
 	logger := GetLogger()
-	logger.Info("HttpRequestMessage", zap.String("Method", requestParams.Method), zap.String("URL", requestParams.URL), zap.Int("BodyLen", len(requestParams.Body)))
+	logger.Info("HttpRequestMessage", zap.String("Method", requestParams.Method), zap.String("URL", requestParams.URL), zap.Int("BodyLen", len(requestParams.Body)), zap.Bool("Stream", requestParams.Stream))
+
+	var body io.Reader
+	if requestParams.Stream {
+		reader := wss.streams.Reader(requestParams.ID)
+		defer reader.Close()
+		body = reader
+	}
 
 	if err := RequestAllowed(requestParams, config); err != nil {
 		return err
 	}
 
-	res, err := HttpRequest(requestParams, config)
+	res, resBody, err := HttpRequestStream(requestParams, body, config)
 	if err != nil {
 		return err
 	}
+	defer resBody.Close()
+	if requestParams.cancelled() {
+		return ErrRequestCancelled
+	}
+	res.ID = requestParams.ID
+
+	return SendResponseStream(*res, resBody, wss)
+}
+
+// SendResponseStream sends a response whose body is read from body. Bodies
+// that fit in a single frame are sent inline, larger ones are streamed.
+// Incremental bodies (SSE, chunked) are always streamed, frame by frame as
+// they are produced.
+func SendResponseStream(resMsg HttpResponseMessage, body io.Reader, wss *WebSocketServer) error {
+	var prefix []byte
+	if !isIncrementalResponse(resMsg.Headers) {
+		var complete bool
+		var err error
+		prefix, complete, err = readPrefix(body, streamFrameSize)
+		if err != nil {
+			return err
+		}
+		if complete {
+			resMsg.Body, resMsg.Encoding = compressBody(wss.compressFor(resMsg.Headers), prefix, wss.config.COMPRESSION_MIN_SIZE)
+			return SendResponseMessage(resMsg, wss)
+		}
+	}
+
+	resMsg.Stream = true
+	if err := SendResponseMessage(resMsg, wss); err != nil {
+		return err
+	}
 
-	return SendResponseMessage(*res, wss)
+	// The response head is already sent, so failures from here on are
+	// reported on the stream instead of as an error response.
+	writer := wss.streams.Writer(resMsg.ID)
+	writer.compress(wss.compressFor(resMsg.Headers), wss.config.COMPRESSION_MIN_SIZE)
+	_, err := io.CopyBuffer(writer, io.MultiReader(bytes.NewReader(prefix), body), make([]byte, streamFrameSize))
+	if err == nil {
+		return writer.Close()
+	}
+	if errors.Is(err, ErrStreamReset) || errors.Is(err, ErrTunnelClosed) {
+		logger.Debug("Response stream stopped", zap.String("ID", resMsg.ID), zap.String("reason", err.Error()))
+		return nil
+	}
+	logger.Warn("Error streaming response", zap.String("ID", resMsg.ID), zap.String("error", err.Error()))
+	writer.CloseWithError(err)
+	return nil
 }
 
-func SendResponseMessage(resMsg HttpResponseMessage, wss *socketflow.WebSocketClient) error {
-	logger.Debug("SendResponse", zap.Int("StatusCode", resMsg.StatusCode))
+func SendResponseMessage(resMsg HttpResponseMessage, wss *WebSocketServer) error {
+	logger.Debug("SendResponse", zap.String("ID", resMsg.ID), zap.Int("StatusCode", resMsg.StatusCode))
 
-	payload, err := json.Marshal(resMsg)
+	payload, err := marshalPayload(wss.framing, &resMsg, &resMsg.Body)
 	if err != nil {
 		logger.Error("Error marshaling response", zap.String("error", err.Error()))
 		return err
 	}
 
-	id, err := wss.SendMessage("response", payload)
+	id, err := sendMessage(wss.conn, "response", payload)
 	if err != nil {
 		logger.Error("Error in send response", zap.String("error", err.Error()))
 		return err
@@ -0,0 +1,136 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/niradler/go-netbridge/tunnel"
+	"go.uber.org/zap"
+)
+
+var ErrTunnelDraining = errors.New("tunnel is shutting down")
+
+// drain tells the peer this side is shutting down, so it sends no new requests.
+func (wss *WebSocketServer) drain() {
+	wss.draining.Store(true)
+	if !wss.peer.Has(tunnel.FeatureDrain) {
+		return
+	}
+	if _, err := sendMessage(wss.conn, "drain", []byte("{}")); err != nil {
+		GetLogger().Debug("Failed to send drain", zap.String("client", wss.Name), zap.String("error", err.Error()))
+	}
+}
+
+func (wss *WebSocketServer) handleDrain() {
+	wss.peerDraining.Store(true)
+	GetLogger().Info("Peer is shutting down, sending it no new requests", zap.String("client", wss.Name), zap.String("remoteAddr", wss.RemoteAddr))
+}
+
+// busy returns the number of requests from the peer still being handled.
+func (wss *WebSocketServer) busy() int64 {
+	return wss.active.Load() + wss.queued.Load()
+}
+
+// connections returns the tunnel connections of this side.
+func (hs *HTTPServer) connections() []*WebSocketServer {
+	if hs.tunnel != nil {
+		if wss, ok := hs.tunnel.Connection(); ok {
+			return []*WebSocketServer{wss}
+		}
+		return nil
+	}
+	return hs.clients.Connections()
+}
+
+// Shutdown stops accepting HTTP requests and TCP forwards, tells the peers
+// the tunnel is draining, and waits until ctx is done for in-flight requests
+// in both directions. The tunnels are then closed with a close frame, and the
+// spans not yet exported are sent to the collector.
+func (hs *HTTPServer) Shutdown(ctx context.Context) error {
+	logger := GetLogger()
+	hs.draining.Store(true)
+	hs.mu.Lock()
+	for _, ln := range hs.listeners {
+		ln.Close()
+	}
+	hs.mu.Unlock()
+
+	tunnels := hs.connections()
+	for _, wss := range tunnels {
+		wss.drain()
+	}
+
+	// Requests proxied by this side, including those waiting on the peer.
+	err := hs.server.Shutdown(ctx)
+	if err != nil {
+		hs.server.Close()
+	}
+
+	// Requests the peer sent this side.
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for _, wss := range tunnels {
+		for wss.busy() > 0 && ctx.Err() == nil {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+		if n := wss.busy(); n > 0 {
+			logger.Warn("Shutdown timeout reached, dropping requests from the peer", zap.String("client", wss.Name), zap.Int64("requests", n))
+		}
+	}
+	if ctx.Err() != nil && err == nil {
+		err = ctx.Err()
+	}
+
+	if hs.tunnel != nil {
+		hs.tunnel.Close()
+	} else {
+		for _, wss := range tunnels {
+			wss.Close()
+		}
+	}
+
+	if terr := tracerFor(hs.config).Shutdown(ctx); terr != nil {
+		logger.Warn("Failed to export the remaining spans", zap.String("error", terr.Error()))
+	}
+	return err
+}
+
+// Serve runs Start until SIGINT or SIGTERM, then shuts down, giving in-flight
+// requests SHUTDOWN_TIMEOUT to finish. A second signal stops the process at once.
+func (hs *HTTPServer) Serve() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- hs.Start()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	logger := GetLogger()
+	logger.Info("Shutting down", zap.Duration("timeout", hs.config.SHUTDOWN_TIMEOUT))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), hs.config.SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := hs.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown did not complete within %s: %w", hs.config.SHUTDOWN_TIMEOUT, err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	logger.Info("Shutdown complete")
+	return nil
+}
@@ -0,0 +1,160 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+var ErrBlockedAddress = errors.New("address not allowed")
+
+// defaultBlockedNetworks are loopback, private, link-local (including cloud
+// metadata at 169.254.169.254) and other non-public ranges.
+var defaultBlockedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// DialGuard dials upstream connections, refusing addresses in blocked
+// networks or ruled out by the egress policy. The host is resolved once and
+// only the checked addresses are dialed, so a name cannot be rebound to a
+// refused address in between.
+type DialGuard struct {
+	blocked []*net.IPNet
+	allowed []*net.IPNet
+	policy  *EgressPolicy
+}
+
+// openDialer dials without restrictions, for targets this side declared itself.
+var openDialer = &DialGuard{}
+
+func NewDialGuard(blocked, allowed []string) (*DialGuard, error) {
+	g := &DialGuard{}
+	for _, cidr := range blocked {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("BLOCKED_NETWORKS: %w", err)
+		}
+		g.blocked = append(g.blocked, network)
+	}
+	for _, cidr := range allowed {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("ALLOWED_NETWORKS: %w", err)
+		}
+		g.allowed = append(g.allowed, network)
+	}
+	return g, nil
+}
+
+func (g *DialGuard) check(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range g.allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range g.blocked {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: %s", ErrBlockedAddress, ip)
+		}
+	}
+	return nil
+}
+
+// DialContext resolves addr and dials the first reachable address. It fails
+// if any address of the host is blocked.
+func (g *DialGuard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if err := g.check(ip); err != nil {
+			metrics.rejected("blocked_address")
+			return nil, fmt.Errorf("dial %s: %w", host, err)
+		}
+	}
+	portNum, _ := strconv.Atoi(port)
+	if err := g.policy.CheckDial(host, portNum, ips); err != nil {
+		metrics.rejected("policy")
+		return nil, fmt.Errorf("dial %s: %w", host, err)
+	}
+
+	dialer := &net.Dialer{}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Dial dials addr within tcpDialTimeout, in the form fasthttp expects.
+func (g *DialGuard) Dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tcpDialTimeout)
+	defer cancel()
+	return g.DialContext(ctx, "tcp", addr)
+}
+
+var guards sync.Map // *config.Config -> *DialGuard
+
+// dialerFor returns the dialer for an upstream request. Trusted requests,
+// like those for published services, dial without restrictions.
+func dialerFor(req *HttpRequestMessage, cfg *config.Config) (*DialGuard, error) {
+	if req.trusted {
+		return openDialer, nil
+	}
+	if g, ok := guards.Load(cfg); ok {
+		return g.(*DialGuard), nil
+	}
+	blocked := cfg.BLOCKED_NETWORKS
+	if !cfg.ALLOW_PRIVATE_NETWORKS {
+		blocked = append(append([]string{}, defaultBlockedNetworks...), blocked...)
+	}
+	g, err := NewDialGuard(blocked, cfg.ALLOWED_NETWORKS)
+	if err != nil {
+		return nil, err
+	}
+	if g.policy, err = policyFor(cfg); err != nil {
+		return nil, err
+	}
+	guards.Store(cfg, g)
+	return g, nil
+}
@@ -0,0 +1,114 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+func TestDialGuardCheck(t *testing.T) {
+	defaults, err := NewDialGuard(defaultBlockedNetworks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overridden, err := NewDialGuard(defaultBlockedNetworks, []string{"10.1.0.0/16", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		guard   *DialGuard
+		ip      string
+		blocked bool
+	}{
+		{defaults, "127.0.0.1", true},
+		{defaults, "10.1.2.3", true},
+		{defaults, "172.16.0.1", true},
+		{defaults, "192.168.1.1", true},
+		{defaults, "169.254.169.254", true},
+		{defaults, "100.64.0.1", true},
+		{defaults, "0.0.0.0", true},
+		{defaults, "::1", true},
+		{defaults, "::", true},
+		{defaults, "fd00::1", true},
+		{defaults, "fe80::1", true},
+		{defaults, "::ffff:127.0.0.1", true},
+		{defaults, "::ffff:169.254.169.254", true},
+		{defaults, "93.184.216.34", false},
+		{defaults, "2606:4700::1111", false},
+		{overridden, "10.1.2.3", false},
+		{overridden, "::ffff:10.1.2.3", false},
+		{overridden, "::1", false},
+		{overridden, "10.2.0.1", true},
+		{overridden, "127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		err := tt.guard.check(net.ParseIP(tt.ip))
+		if tt.blocked && !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("check(%s) = %v, want %v", tt.ip, err, ErrBlockedAddress)
+		}
+		if !tt.blocked && err != nil {
+			t.Errorf("check(%s) = %v, want allowed", tt.ip, err)
+		}
+	}
+
+	if _, err := NewDialGuard([]string{"10.0.0.0/99"}, nil); err == nil {
+		t.Error("NewDialGuard accepted an invalid CIDR")
+	}
+}
+
+func TestDialGuardRefusesBlockedDial(t *testing.T) {
+	g, err := NewDialGuard(defaultBlockedNetworks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"127.0.0.1:80", "[::ffff:127.0.0.1]:80", "localhost:80"} {
+		if _, err := g.Dial(addr); !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("Dial(%s) = %v, want %v", addr, err, ErrBlockedAddress)
+		}
+	}
+}
+
+func TestRedirectToBlockedAddress(t *testing.T) {
+	InitLogger(config.Config{})
+	var target string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			io.WriteString(w, "ok")
+			return
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	// The upstream itself is allowed; any other loopback address is not.
+	cfg := &config.Config{
+		Type:                     "client",
+		ALLOWED_NETWORKS:         []string{"127.0.0.1/32"},
+		REQUEST_TIMEOUT:          5 * time.Second,
+		UPSTREAM_MAX_BUFFER_SIZE: 1 << 20,
+	}
+
+	target = srv.URL + "/ok"
+	_, body, err := HttpRequestStream(&HttpRequestMessage{Method: "GET", URL: srv.URL}, nil, cfg)
+	if err != nil {
+		t.Fatalf("redirect to an allowed address: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "ok" {
+		t.Fatalf("redirect to an allowed address returned %q", data)
+	}
+
+	target = strings.Replace(srv.URL, "127.0.0.1", "127.0.0.2", 1) + "/ok"
+	_, _, err = HttpRequestStream(&HttpRequestMessage{Method: "GET", URL: srv.URL}, nil, cfg)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("redirect to a blocked address = %v, want %v", err, ErrBlockedAddress)
+	}
+}
@@ -0,0 +1,415 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/tunnel"
+	"go.uber.org/zap"
+)
+
+const (
+	streamFrameSize = 32 * 1024 // body bytes carried by a single frame
+	maxStreamWindow = 256       // frames a reader buffers before it resets the stream
+)
+
+var (
+	ErrStreamReset  = errors.New("stream reset by peer")
+	ErrTunnelClosed = errors.New("tunnel connection closed")
+)
+
+// StreamFrame carries a slice of a request or response body. Frames of a
+// stream share the ID of the request they belong to.
+type StreamFrame struct {
+	ID       string `json:"id"`
+	Seq      int    `json:"seq"`
+	Data     []byte `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"` // codec Data is compressed with
+	EOF      bool   `json:"eof,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// StreamAck grants the sender of a stream more frames, or resets the stream
+// when the receiver is no longer interested in it.
+type StreamAck struct {
+	ID     string `json:"id"`
+	Credit int    `json:"credit,omitempty"`
+	Reset  bool   `json:"reset,omitempty"`
+}
+
+// StreamManager multiplexes body streams over a single tunnel connection.
+// Each stream has its own window: a writer may have at most window frames
+// unacknowledged, so a slow reader only holds up its own stream.
+type StreamManager struct {
+	conn    *tunnel.Conn
+	done    <-chan struct{}
+	window  int
+	framing string
+	mu      sync.Mutex
+	readers map[string]*StreamReader
+	writers map[string]*StreamWriter
+}
+
+func NewStreamManager(conn *tunnel.Conn, done <-chan struct{}, window int) *StreamManager {
+	if window <= 0 || window > maxStreamWindow {
+		window = maxStreamWindow
+	}
+	return &StreamManager{
+		conn:    conn,
+		done:    done,
+		window:  window,
+		readers: make(map[string]*StreamReader),
+		writers: make(map[string]*StreamWriter),
+	}
+}
+
+// Reader returns the incoming stream with the given ID, creating it if no
+// frame has arrived yet. The caller owns the stream and must close it.
+func (sm *StreamManager) Reader(id string) *StreamReader {
+	r := sm.reader(id)
+	r.mu.Lock()
+	r.claimed = true
+	r.mu.Unlock()
+	return r
+}
+
+func (sm *StreamManager) reader(id string) *StreamReader {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if r, ok := sm.readers[id]; ok {
+		return r
+	}
+	r := &StreamReader{
+		id:         id,
+		manager:    sm,
+		notify:     make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		lastActive: time.Now(),
+	}
+	sm.readers[id] = r
+	return r
+}
+
+// Writer registers an outgoing stream with the given ID.
+func (sm *StreamManager) Writer(id string) *StreamWriter {
+	w := &StreamWriter{
+		id:      id,
+		manager: sm,
+		credits: make(chan struct{}, sm.window),
+		reset:   make(chan struct{}),
+	}
+	for i := 0; i < sm.window; i++ {
+		w.credits <- struct{}{}
+	}
+	sm.mu.Lock()
+	sm.writers[id] = w
+	sm.mu.Unlock()
+	return w
+}
+
+func (sm *StreamManager) removeReader(r *StreamReader) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.readers[r.id] == r {
+		delete(sm.readers, r.id)
+	}
+}
+
+func (sm *StreamManager) removeWriter(w *StreamWriter) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.writers[w.id] == w {
+		delete(sm.writers, w.id)
+	}
+}
+
+func (sm *StreamManager) sendFrame(frame *StreamFrame) error {
+	payload, err := marshalPayload(sm.framing, frame, &frame.Data)
+	if err != nil {
+		return err
+	}
+	_, err = sendMessage(sm.conn, "stream", payload)
+	return err
+}
+
+func (sm *StreamManager) sendAck(ack *StreamAck) error {
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	_, err = sendMessage(sm.conn, "stream-ack", payload)
+	return err
+}
+
+// HandleFrame queues an incoming frame on its stream. It never blocks.
+func (sm *StreamManager) HandleFrame(frame *StreamFrame) {
+	r := sm.reader(frame.ID)
+	if !r.push(frame) {
+		GetLogger().Error("Stream window exceeded, resetting stream", zap.String("id", frame.ID))
+		r.Close()
+	}
+}
+
+// HandleAck applies credit or a reset to an outgoing stream. It never blocks.
+func (sm *StreamManager) HandleAck(ack *StreamAck) {
+	sm.mu.Lock()
+	w, ok := sm.writers[ack.ID]
+	sm.mu.Unlock()
+	if !ok {
+		return
+	}
+	if ack.Reset {
+		w.abort()
+		return
+	}
+	for i := 0; i < ack.Credit; i++ {
+		select {
+		case w.credits <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sweep removes incoming streams that nobody has claimed and that received
+// no frame for longer than idle.
+func (sm *StreamManager) Sweep(idle time.Duration) int {
+	sm.mu.Lock()
+	var stale []*StreamReader
+	for _, r := range sm.readers {
+		if r.orphanedFor() > idle {
+			stale = append(stale, r)
+		}
+	}
+	sm.mu.Unlock()
+	for _, r := range stale {
+		r.Close()
+	}
+	return len(stale)
+}
+
+// StartSweeper periodically removes orphaned incoming streams until the tunnel closes.
+func (sm *StreamManager) StartSweeper(idle time.Duration) {
+	go func() {
+		ticker := time.NewTicker(idle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if removed := sm.Sweep(idle); removed > 0 {
+					GetLogger().Warn("Removed idle streams", zap.Int("count", removed))
+				}
+			case <-sm.done:
+				return
+			}
+		}
+	}()
+}
+
+// StreamReader reads a body stream sent by the peer. Every frame taken off
+// the queue returns one credit to the sender, which bounds buffered data to
+// the sender's window.
+type StreamReader struct {
+	id         string
+	manager    *StreamManager
+	queue      []*StreamFrame
+	notify     chan struct{}
+	current    []byte
+	err        error
+	closeOnce  sync.Once
+	closed     chan struct{}
+	mu         sync.Mutex
+	claimed    bool
+	lastActive time.Time
+}
+
+// orphanedFor returns how long an unclaimed stream has been idle, or zero once it is claimed.
+func (r *StreamReader) orphanedFor() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.claimed {
+		return 0
+	}
+	return time.Since(r.lastActive)
+}
+
+// push queues a frame and reports false if the sender overran the window.
+// The frame ending the stream takes no credit, so it may follow a full window.
+func (r *StreamReader) push(frame *StreamFrame) bool {
+	limit := maxStreamWindow
+	if frame.EOF || frame.Error != "" {
+		limit++
+	}
+	r.mu.Lock()
+	if len(r.queue) >= limit {
+		r.mu.Unlock()
+		return false
+	}
+	r.queue = append(r.queue, frame)
+	r.mu.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next takes the next frame off the queue and applies it.
+func (r *StreamReader) next() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.queue) == 0 {
+		return false
+	}
+	frame := r.queue[0]
+	r.queue[0] = nil
+	r.queue = r.queue[1:]
+	r.lastActive = time.Now()
+	r.current = frame.Data
+	if frame.Encoding != "" {
+		data, err := decodeBody(frame.Data, frame.Encoding)
+		if err != nil {
+			r.current, r.err = nil, err
+			return true
+		}
+		r.current = data
+	}
+	switch {
+	case frame.Error != "":
+		r.err = errors.New(frame.Error)
+	case frame.EOF:
+		r.err = io.EOF
+	}
+	return true
+}
+
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.next() {
+			if r.err == nil {
+				r.manager.sendAck(&StreamAck{ID: r.id, Credit: 1})
+			}
+			continue
+		}
+		select {
+		case <-r.notify:
+		case <-r.closed:
+			return 0, io.ErrClosedPipe
+		case <-r.manager.done:
+			return 0, ErrTunnelClosed
+		}
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close stops reading the stream. If the stream did not reach its end the
+// sender is told to stop.
+func (r *StreamReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.manager.removeReader(r)
+		r.mu.Lock()
+		finished := r.err != nil
+		r.mu.Unlock()
+		if !finished {
+			r.manager.sendAck(&StreamAck{ID: r.id, Reset: true})
+		}
+	})
+	return nil
+}
+
+// StreamWriter sends a body stream to the peer, blocking whenever the
+// stream window is used up until the reader acknowledges frames.
+type StreamWriter struct {
+	id        string
+	manager   *StreamManager
+	seq       int
+	credits   chan struct{}
+	resetOnce sync.Once
+	reset     chan struct{}
+	codec     *codec
+	minSize   int
+}
+
+// compress makes the writer compress frames with c, nil for none.
+func (w *StreamWriter) compress(c *codec, minSize int) {
+	w.codec, w.minSize = c, minSize
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > streamFrameSize {
+			n = streamFrameSize
+		}
+		// A reset wins over credit still left from before it.
+		select {
+		case <-w.reset:
+			return written, ErrStreamReset
+		default:
+		}
+		select {
+		case <-w.credits:
+		case <-w.reset:
+			return written, ErrStreamReset
+		case <-w.manager.done:
+			return written, ErrTunnelClosed
+		}
+		w.seq++
+		data, encoding := compressBody(w.codec, p[:n], w.minSize)
+		if encoding == "" && n >= w.minSize {
+			// The content does not shrink, so stop trying for this stream.
+			w.codec = nil
+		}
+		if err := w.manager.sendFrame(&StreamFrame{ID: w.id, Seq: w.seq, Data: data, Encoding: encoding}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream successfully.
+func (w *StreamWriter) Close() error {
+	defer w.manager.removeWriter(w)
+	w.seq++
+	return w.manager.sendFrame(&StreamFrame{ID: w.id, Seq: w.seq, EOF: true})
+}
+
+// CloseWithError ends the stream and makes the reader fail with err.
+func (w *StreamWriter) CloseWithError(err error) error {
+	defer w.manager.removeWriter(w)
+	w.seq++
+	return w.manager.sendFrame(&StreamFrame{ID: w.id, Seq: w.seq, Error: err.Error()})
+}
+
+// abort unblocks pending writes without notifying the peer.
+func (w *StreamWriter) abort() {
+	w.resetOnce.Do(func() {
+		close(w.reset)
+	})
+	w.manager.removeWriter(w)
+}
+
+// readPrefix reads up to size bytes from r and reports whether r was exhausted.
+func readPrefix(r io.Reader, size int) ([]byte, bool, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+		return buf[:n], false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return buf[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
@@ -0,0 +1,117 @@
+package shared
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+func TestStreamReaderWindow(t *testing.T) {
+	sm := NewStreamManager(nil, make(chan struct{}), 0)
+	r := sm.reader("1")
+	for seq := 1; seq <= maxStreamWindow; seq++ {
+		if !r.push(&StreamFrame{ID: "1", Seq: seq, Data: []byte("x")}) {
+			t.Fatalf("frame %d rejected within the window", seq)
+		}
+	}
+	if r.push(&StreamFrame{ID: "1", Seq: maxStreamWindow + 1, Data: []byte("x")}) {
+		t.Error("data frame beyond the window accepted")
+	}
+	if !r.push(&StreamFrame{ID: "1", Seq: maxStreamWindow + 1, EOF: true}) {
+		t.Fatal("EOF frame after a full window rejected")
+	}
+
+	r.mu.Lock()
+	r.claimed = true
+	r.mu.Unlock()
+	for i := 0; i < maxStreamWindow; i++ {
+		if !r.next() || string(r.current) != "x" {
+			t.Fatalf("frame %d: got %q", i+1, r.current)
+		}
+		r.current = nil
+	}
+	if !r.next() || r.err != io.EOF {
+		t.Errorf("last frame: err = %v, want EOF", r.err)
+	}
+}
+
+func TestStreamCredit(t *testing.T) {
+	_, toClient, toServer := startTunnel(t, config.Config{STREAM_WINDOW: 2}, config.Config{STREAM_WINDOW: 2})
+	body := bytes.Repeat([]byte("0123456789abcdef"), 5*streamFrameSize/16)
+
+	w := toClient.streams.Writer("credit")
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(body)
+		if err == nil {
+			err = w.Close()
+		}
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("Write of 5 frames with a window of 2 returned %v before anything was read", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r := toServer.streams.Reader("credit")
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("read %d bytes, want %d", len(got), len(body))
+	}
+	if err := <-written; err != nil {
+		t.Errorf("Write: %v", err)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	_, toClient, toServer := startTunnel(t, config.Config{STREAM_WINDOW: 2}, config.Config{STREAM_WINDOW: 2})
+
+	w := toClient.streams.Writer("reset")
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 10*streamFrameSize))
+		written <- err
+	}()
+	r := toServer.streams.Reader("reset")
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	select {
+	case err := <-written:
+		if !errors.Is(err, ErrStreamReset) {
+			t.Errorf("Write after the reader closed = %v, want %v", err, ErrStreamReset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not stop after the reader closed")
+	}
+}
+
+func TestStreamWindowOverrunResets(t *testing.T) {
+	_, toClient, toServer := startTunnel(t, config.Config{}, config.Config{})
+
+	// A peer ignoring its window: frames beyond it reset the stream.
+	w := toClient.streams.Writer("overrun")
+	for seq := 1; seq <= maxStreamWindow+1; seq++ {
+		toServer.streams.HandleFrame(&StreamFrame{ID: "overrun", Seq: seq, Data: []byte("x")})
+	}
+
+	select {
+	case <-w.reset:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer was not reset")
+	}
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("Write after an overrun = %v, want %v", err, ErrStreamReset)
+	}
+}
@@ -0,0 +1,201 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/niradler/go-netbridge/tunnel"
+	"go.uber.org/zap"
+)
+
+const tcpDialTimeout = 10 * time.Second
+
+// TCPForward is a local listener whose connections are forwarded through the
+// tunnel to Target, which the peer dials. On the server Client picks the
+// tunnel client that dials it.
+type TCPForward struct {
+	Listen string
+	Client string
+	Target string
+}
+
+// ParseTCPForward parses "listen=[client@]target", e.g. "127.0.0.1:2222=site1@10.0.0.5:22".
+func ParseTCPForward(entry string) (TCPForward, error) {
+	listen, target, found := strings.Cut(entry, "=")
+	if !found || listen == "" || target == "" {
+		return TCPForward{}, fmt.Errorf("invalid TCP forward %q, expected listen=[client@]target", entry)
+	}
+	fwd := TCPForward{Listen: strings.TrimSpace(listen), Target: strings.TrimSpace(target)}
+	if client, rest, found := strings.Cut(fwd.Target, "@"); found {
+		fwd.Client = client
+		fwd.Target = rest
+	}
+	if _, _, err := net.SplitHostPort(fwd.Target); err != nil {
+		return TCPForward{}, fmt.Errorf("invalid TCP forward target %q: %w", fwd.Target, err)
+	}
+	return fwd, nil
+}
+
+// startTCPForwards starts a listener for every configured TCP forward.
+func (hs *HTTPServer) startTCPForwards() error {
+	logger := GetLogger()
+	for _, entry := range hs.config.TCP_FORWARDS {
+		fwd, err := ParseTCPForward(entry)
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", fwd.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for TCP forward %s: %w", fwd.Listen, err)
+		}
+		logger.Info("Forwarding TCP", zap.String("listen", ln.Addr().String()), zap.String("client", fwd.Client), zap.String("target", fwd.Target))
+		hs.mu.Lock()
+		hs.listeners = append(hs.listeners, ln)
+		hs.mu.Unlock()
+		go hs.serveTCPForward(fwd, ln)
+	}
+	return nil
+}
+
+func (hs *HTTPServer) serveTCPForward(fwd TCPForward, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !hs.draining.Load() {
+				GetLogger().Error("TCP forward listener stopped", zap.String("listen", fwd.Listen), zap.String("error", err.Error()))
+			}
+			return
+		}
+		go hs.forwardTCP(fwd, conn)
+	}
+}
+
+func (hs *HTTPServer) forwardTCP(fwd TCPForward, conn net.Conn) {
+	logger := GetLogger()
+	wss, ok := hs.tunnelByName(fwd.Client)
+	if !ok {
+		logger.Warn("No tunnel connection for TCP forward", zap.String("client", fwd.Client), zap.String("target", fwd.Target))
+		conn.Close()
+		return
+	}
+
+	id, err := wss.DialTCP(context.Background(), fwd.Target)
+	if err != nil {
+		logger.Warn("TCP forward failed", zap.String("target", fwd.Target), zap.String("error", err.Error()))
+		conn.Close()
+		return
+	}
+
+	logger.Debug("TCP connection opened", zap.String("id", id), zap.String("remoteAddr", conn.RemoteAddr().String()), zap.String("target", fwd.Target))
+	wss.pipe(conn, id)
+	logger.Debug("TCP connection closed", zap.String("id", id))
+}
+
+// DialTCP asks the peer to open a TCP connection to target and returns the
+// stream ID its bytes travel on.
+func (wss *WebSocketServer) DialTCP(ctx context.Context, target string) (string, error) {
+	if !wss.peer.Has(tunnel.FeatureTCP) {
+		return "", fmt.Errorf("peer %s does not support TCP forwarding", wss.peer.Version)
+	}
+	req := &HttpRequestMessage{
+		Method:  http.MethodConnect,
+		URL:     "tcp://" + target,
+		Headers: map[string][]string{},
+	}
+	res, body, err := wss.Request(ctx, req, nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if res.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(body)
+		return "", fmt.Errorf("peer refused TCP connection (%d): %s", res.StatusCode, reason)
+	}
+	return req.ID, nil
+}
+
+// handleConnect dials the target of a CONNECT request on behalf of the peer.
+func (wss *WebSocketServer) handleConnect(req *HttpRequestMessage) {
+	logger := GetLogger()
+	reply := func(status int, body string) error {
+		return SendResponseMessage(HttpResponseMessage{
+			ID:         req.ID,
+			StatusCode: status,
+			Headers:    map[string][]string{},
+			Body:       []byte(body),
+		}, wss)
+	}
+
+	if err := RequestAllowed(req, wss.config); err != nil {
+		reply(http.StatusForbidden, err.Error())
+		return
+	}
+
+	dialer, err := dialerFor(req, wss.config)
+	if err != nil {
+		reply(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	target := strings.TrimPrefix(req.URL, "tcp://")
+	conn, err := dialer.Dial(target)
+	if errors.Is(err, ErrBlockedAddress) {
+		logger.Warn("TCP dial blocked", zap.String("target", target), zap.String("error", err.Error()))
+		reply(http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Warn("TCP dial failed", zap.String("target", target), zap.String("error", err.Error()))
+		reply(http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if err := reply(http.StatusOK, ""); err != nil {
+		conn.Close()
+		return
+	}
+
+	logger.Debug("TCP connection opened", zap.String("id", req.ID), zap.String("target", target))
+	wss.pipe(conn, req.ID)
+	logger.Debug("TCP connection closed", zap.String("id", req.ID))
+}
+
+// pipe relays conn over the stream pair with the given ID until both
+// directions are finished. A clean end of one direction is passed on as a
+// half-close, an error in either direction tears the connection down.
+func (wss *WebSocketServer) pipe(conn net.Conn, id string) {
+	writer := wss.streams.Writer(id)
+	reader := wss.streams.Reader(id)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		_, err := io.CopyBuffer(writer, conn, make([]byte, streamFrameSize))
+		switch {
+		case err == nil:
+			writer.Close()
+		case errors.Is(err, ErrStreamReset), errors.Is(err, ErrTunnelClosed):
+			conn.Close()
+		default:
+			writer.CloseWithError(err)
+		}
+	}()
+
+	_, err := io.CopyBuffer(conn, reader, make([]byte, streamFrameSize))
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+		cw.CloseWrite()
+	} else {
+		conn.Close()
+	}
+	reader.Close()
+
+	<-sent
+	writer.abort()
+	conn.Close()
+}
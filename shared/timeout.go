@@ -0,0 +1,116 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/valyala/fasthttp"
+)
+
+type routeTimeout struct {
+	host    string
+	path    string
+	timeout time.Duration
+}
+
+// RouteTimeouts holds the time requests may take per route, from
+// ROUTE_TIMEOUTS entries keyed by "/path", "host" or "host/path".
+type RouteTimeouts struct {
+	routes   []routeTimeout
+	fallback time.Duration
+}
+
+func NewRouteTimeouts(entries map[string]string, fallback time.Duration) (*RouteTimeouts, error) {
+	rt := &RouteTimeouts{fallback: fallback}
+	for route, value := range entries {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("ROUTE_TIMEOUTS: invalid timeout %q for %s", value, route)
+		}
+		host, path := route, ""
+		if i := strings.Index(route, "/"); i >= 0 {
+			host, path = route[:i], route[i:]
+		}
+		rt.routes = append(rt.routes, routeTimeout{host: strings.ToLower(host), path: path, timeout: timeout})
+	}
+	return rt, nil
+}
+
+// For returns the timeout of the most specific route matching r: a host
+// match beats a path-only match, a longer path beats a shorter one.
+func (rt *RouteTimeouts) For(r *http.Request) time.Duration {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	timeout, best := rt.fallback, -1
+	for _, route := range rt.routes {
+		if route.host != "" && route.host != host {
+			continue
+		}
+		if route.path != "" && !matchPathPrefix(r.URL.Path, route.path) {
+			continue
+		}
+		score := len(route.path)
+		if route.host != "" {
+			score += 1 << 16
+		}
+		if score > best {
+			timeout, best = route.timeout, score
+		}
+	}
+	return timeout
+}
+
+var routeTimeouts sync.Map // *config.Config -> *RouteTimeouts
+
+// routeTimeoutsFor returns the route timeouts of a config, parsed once.
+func routeTimeoutsFor(cfg *config.Config) (*RouteTimeouts, error) {
+	if rt, ok := routeTimeouts.Load(cfg); ok {
+		return rt.(*RouteTimeouts), nil
+	}
+	rt, err := NewRouteTimeouts(cfg.ROUTE_TIMEOUTS, cfg.REQUEST_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	routeTimeouts.Store(cfg, rt)
+	return rt, nil
+}
+
+// routeTimeout returns how long the request r may take.
+func (hs *HTTPServer) routeTimeout(r *http.Request) time.Duration {
+	rt, err := routeTimeoutsFor(hs.config)
+	if err != nil {
+		return hs.config.REQUEST_TIMEOUT
+	}
+	return rt.For(r)
+}
+
+// receiveDeadline sets the deadline of a request received over the tunnel.
+// The timeout travels relative to the send time, so the clocks of both sides
+// need not agree.
+func (req *HttpRequestMessage) receiveDeadline(fallback time.Duration) {
+	timeout := fallback
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+	req.deadline = time.Now().Add(timeout)
+}
+
+// isTimeout reports whether err means a request ran out of time.
+func isTimeout(err error) bool {
+	if errors.Is(err, ErrRequestTimeout) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, fasthttp.ErrTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
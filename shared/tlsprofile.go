@@ -0,0 +1,187 @@
+package shared
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/niradler/go-netbridge/tunnel"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSProfile describes how upstream TLS connections are made. Unset fields of
+// a per-host profile fall back to the defaults from the environment.
+type TLSProfile struct {
+	CAFile             string   `json:"ca_file"`
+	CertFile           string   `json:"cert_file"`
+	KeyFile            string   `json:"key_file"`
+	ServerName         string   `json:"server_name"`
+	InsecureSkipVerify *bool    `json:"insecure_skip_verify"`
+	MinVersion         string   `json:"min_version"`
+	Ciphers            []string `json:"ciphers"`
+}
+
+func (p TLSProfile) merge(override TLSProfile) TLSProfile {
+	if override.CAFile != "" {
+		p.CAFile = override.CAFile
+	}
+	if override.CertFile != "" {
+		p.CertFile = override.CertFile
+		p.KeyFile = override.KeyFile
+	}
+	if override.ServerName != "" {
+		p.ServerName = override.ServerName
+	}
+	if override.InsecureSkipVerify != nil {
+		p.InsecureSkipVerify = override.InsecureSkipVerify
+	}
+	if override.MinVersion != "" {
+		p.MinVersion = override.MinVersion
+	}
+	if len(override.Ciphers) > 0 {
+		p.Ciphers = override.Ciphers
+	}
+	return p
+}
+
+func (p TLSProfile) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         p.ServerName,
+		InsecureSkipVerify: p.InsecureSkipVerify != nil && *p.InsecureSkipVerify,
+	}
+	if p.CAFile != "" {
+		pool, err := tunnel.LoadCertPool(p.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if p.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if p.MinVersion != "" {
+		version, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", p.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	for _, name := range p.Ciphers {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return tlsConfig, nil
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// UpstreamTLS holds the TLS configuration for upstream requests: a default
+// and per-destination overrides keyed by "host", "host:port" or "*.domain".
+type UpstreamTLS struct {
+	defaults *tls.Config
+	hosts    map[string]*tls.Config
+}
+
+func NewUpstreamTLS(cfg *config.Config) (*UpstreamTLS, error) {
+	defaults := TLSProfile{
+		CAFile:             cfg.REQUEST_CA_FILE,
+		CertFile:           cfg.REQUEST_CERT_FILE,
+		KeyFile:            cfg.REQUEST_KEY_FILE,
+		InsecureSkipVerify: &cfg.INSECURE_SKIP_VERIFY,
+		MinVersion:         cfg.REQUEST_TLS_MIN_VERSION,
+		Ciphers:            cfg.REQUEST_TLS_CIPHERS,
+	}
+
+	u := &UpstreamTLS{hosts: make(map[string]*tls.Config)}
+	var err error
+	if u.defaults, err = defaults.tlsConfig(); err != nil {
+		return nil, err
+	}
+
+	if cfg.UPSTREAM_TLS_FILE == "" {
+		return u, nil
+	}
+	data, err := os.ReadFile(cfg.UPSTREAM_TLS_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UPSTREAM_TLS_FILE: %w", err)
+	}
+	var profiles map[string]TLSProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_TLS_FILE: %w", err)
+	}
+	for host, profile := range profiles {
+		tlsConfig, err := defaults.merge(profile).tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_TLS_FILE %s: %w", host, err)
+		}
+		u.hosts[strings.ToLower(host)] = tlsConfig
+	}
+	return u, nil
+}
+
+// For returns the TLS configuration for a destination address, host[:port].
+// The most specific match wins: host:port, host, then the closest wildcard.
+func (u *UpstreamTLS) For(addr string) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	if tlsConfig, ok := u.hosts[strings.ToLower(addr)]; ok {
+		return tlsConfig
+	}
+	if tlsConfig, ok := u.hosts[host]; ok {
+		return tlsConfig
+	}
+	for domain := host; ; {
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		if tlsConfig, ok := u.hosts["*."+parent]; ok {
+			return tlsConfig
+		}
+		domain = parent
+	}
+	return u.defaults
+}
+
+var upstreamTLS sync.Map // *config.Config -> *UpstreamTLS
+
+// upstreamTLSFor returns the upstream TLS configuration of a config, loaded once.
+func upstreamTLSFor(cfg *config.Config) (*UpstreamTLS, error) {
+	if u, ok := upstreamTLS.Load(cfg); ok {
+		return u.(*UpstreamTLS), nil
+	}
+	u, err := NewUpstreamTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upstreamTLS.Store(cfg, u)
+	return u, nil
+}
@@ -0,0 +1,400 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"go.uber.org/zap"
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+)
+
+// SpanContext identifies a span, as carried in a W3C traceparent header.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceParent parses a W3C traceparent value: version-traceid-spanid-flags.
+func ParseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Span is one timed hop of a request. A nil Span records nothing, so callers
+// need not check whether tracing is enabled.
+type Span struct {
+	tracer     *Tracer
+	context    SpanContext
+	parent     [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	failure    string
+}
+
+// Child starts a span under s.
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.Start(name, kind, s, "")
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a string, int or bool attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// Fail marks the span as failed with err.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failure = err.Error()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.context.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+// Tracer creates spans and exports them in batches to an OTLP/HTTP collector,
+// encoded as JSON.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+	flush    chan chan struct{}
+}
+
+func NewTracer(cfg *config.Config) *Tracer {
+	service := cfg.OTEL_SERVICE_NAME
+	if service == "" {
+		service = "netbridge-" + cfg.Type
+	}
+	t := &Tracer{
+		endpoint: strings.TrimSuffix(cfg.OTLP_ENDPOINT, "/") + "/v1/traces",
+		headers:  cfg.OTLP_HEADERS,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, traceQueueSize),
+		flush:    make(chan chan struct{}),
+	}
+	go t.exporter()
+	return t
+}
+
+// Start begins a span. Its parent is taken from parent when set, otherwise
+// from the traceparent value, otherwise the span starts a new trace.
+func (t *Tracer) Start(name string, kind int, parent *Span, traceParent string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if parent != nil {
+		s.context.TraceID = parent.context.TraceID
+		s.context.Sampled = parent.context.Sampled
+		s.parent = parent.context.SpanID
+	} else if sc, ok := ParseTraceParent(traceParent); ok {
+		s.context.TraceID = sc.TraceID
+		s.context.Sampled = sc.Sampled
+		s.parent = sc.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Sampled = true
+	}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+func (t *Tracer) export(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		// The collector is not keeping up; losing spans beats blocking requests.
+	}
+}
+
+// Shutdown exports the spans ended so far, waiting until ctx is done.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Tracer) exporter() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, traceBatchSize)
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-t.flush:
+			for n := len(t.queue); n > 0; n-- {
+				batch = append(batch, <-t.queue)
+			}
+			for i := 0; i < len(batch); i += traceBatchSize {
+				t.exportBatch(batch[i:min(i+traceBatchSize, len(batch))])
+			}
+			batch = batch[:0]
+			close(done)
+			continue
+		}
+		t.exportBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) exportBatch(batch []*Span) {
+	if err := t.send(batch); err != nil {
+		GetLogger().Warn("Failed to export spans", zap.Int("spans", len(batch)), zap.String("error", err.Error()))
+	}
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	list := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		var v otlpValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		list = append(list, otlpAttribute{Key: key, Value: v})
+	}
+	return list
+}
+
+// send posts a batch of spans as an OTLP ExportTraceServiceRequest.
+func (t *Tracer) send(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.failure != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.failure}
+		}
+		s.mu.Unlock()
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		spans = append(spans, span)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/niradler/go-netbridge"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %s", res.Status)
+	}
+	return nil
+}
+
+var (
+	tracersMu sync.Mutex
+	tracers   = make(map[*config.Config]*Tracer)
+)
+
+// tracerFor returns the tracer of a config, created once, or nil when
+// OTLP_ENDPOINT is not set and tracing is off.
+func tracerFor(cfg *config.Config) *Tracer {
+	if cfg.OTLP_ENDPOINT == "" {
+		return nil
+	}
+	tracersMu.Lock()
+	defer tracersMu.Unlock()
+	t, ok := tracers[cfg]
+	if !ok {
+		t = NewTracer(cfg)
+		tracers[cfg] = t
+	}
+	return t
+}
+
+type spanKey struct{}
+
+func contextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
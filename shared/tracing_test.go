@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+// collector is an OTLP/HTTP collector keeping the spans it receives.
+type collector struct {
+	mu    sync.Mutex
+	spans []collectedSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []collectedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestTracerExportsLinkedSpans(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	tracer := NewTracer(&config.Config{Type: "client", OTLP_ENDPOINT: srv.URL})
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	root := tracer.Start("proxy GET", spanKindServer, nil, traceParent)
+	transit := root.Child("tunnel GET", spanKindClient)
+	upstream := transit.Child("upstream GET", spanKindClient)
+	upstream.End()
+	transit.End()
+	root.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.spans) != 3 {
+		t.Fatalf("collector received %d spans, want 3", len(c.spans))
+	}
+	byName := make(map[string]collectedSpan)
+	for _, s := range c.spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %q has trace %s, want the caller's", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	for child, parent := range map[string]string{
+		"proxy GET":    "00f067aa0ba902b7",
+		"tunnel GET":   byName["proxy GET"].SpanID,
+		"upstream GET": byName["tunnel GET"].SpanID,
+	} {
+		if got := byName[child].ParentSpanID; got != parent {
+			t.Errorf("span %q has parent %q, want %q", child, got, parent)
+		}
+	}
+}
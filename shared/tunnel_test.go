@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+// startTunnel runs a server and a client connected to it. It returns the
+// server and both ends of the tunnel: the server's connection to the client
+// and the client's connection to the server.
+func startTunnel(t *testing.T, serverCfg, clientCfg config.Config) (*HTTPServer, *WebSocketServer, *WebSocketServer) {
+	t.Helper()
+	InitLogger(config.Config{})
+
+	serverCfg.Type = "server"
+	server, err := config.LoadConfig(&serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := NewHTTPServer(server, nil)
+	NewWebSocketServer(hs)
+	srv := httptest.NewServer(hs.router)
+	t.Cleanup(srv.Close)
+
+	clientCfg.Type = "client"
+	clientCfg.SOCKET_URL = "ws" + strings.TrimPrefix(srv.URL, "http") + "/_ws"
+	if clientCfg.CLIENT_NAME == "" {
+		clientCfg.CLIENT_NAME = "test"
+	}
+	client, err := config.LoadConfig(&clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc, err := NewWebSocketConnection(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(wc.Close)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		toClient, registered := hs.clients.Get(client.CLIENT_NAME)
+		toServer, connected := wc.Connection()
+		if registered && connected {
+			return hs, toClient, toServer
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("tunnel did not connect")
+	return nil, nil, nil
+}
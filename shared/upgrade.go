@@ -0,0 +1,256 @@
+package shared
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"go.uber.org/zap"
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols, e.g. to a WebSocket.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerContainsToken(r.Header, "Connection", "upgrade")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferedConn is a connection whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// dialUpgrade sends an upgrade request to its target over a new connection.
+// On 101 Switching Protocols the connection is returned for relaying,
+// otherwise it is closed once the response body has been read. The request
+// deadline bounds the handshake, and the response body when there is no 101.
+func dialUpgrade(req *HttpRequestMessage, cfg *config.Config) (*http.Response, net.Conn, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer, err := dialerFor(req, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	if req.deadline.IsZero() {
+		req.deadline = time.Now().Add(cfg.REQUEST_TIMEOUT)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secure {
+		tlsProfiles, err := upstreamTLSFor(cfg)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		tlsConfig := tlsProfiles.For(u.Host).Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		conn.SetDeadline(time.Now().Add(tcpDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(req.deadline)
+
+	httpReq, err := http.NewRequest(req.Method, u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	httpReq.Header = http.Header(req.Headers).Clone()
+	httpReq.Header.Del("Content-Length")
+	if err := httpReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, httpReq)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &closeWith{ReadCloser: resp.Body, conn: conn}
+		return resp, nil, nil
+	}
+	// The relayed connection lives as long as both ends keep it open.
+	conn.SetDeadline(time.Time{})
+	return resp, &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// closeWith closes conn together with a response body read from it.
+type closeWith struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (c *closeWith) Close() error {
+	c.ReadCloser.Close()
+	return c.conn.Close()
+}
+
+// handleUpgrade performs an upgrade request on behalf of the peer and, once
+// the target switched protocols, relays the raw connection over the tunnel.
+func (wss *WebSocketServer) handleUpgrade(req *HttpRequestMessage) error {
+	logger := GetLogger()
+	if err := RequestAllowed(req, wss.config); err != nil {
+		return err
+	}
+
+	req.receiveDeadline(wss.config.REQUEST_TIMEOUT)
+	resp, conn, err := dialUpgrade(req, wss.config)
+	if err != nil {
+		return err
+	}
+
+	res := HttpResponseMessage{
+		ID:         req.ID,
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+	}
+	if conn == nil {
+		defer resp.Body.Close()
+		return SendResponseStream(res, resp.Body, wss)
+	}
+
+	if err := SendResponseMessage(res, wss); err != nil {
+		conn.Close()
+		return nil
+	}
+
+	logger.Debug("Upgraded connection opened", zap.String("id", req.ID), zap.String("url", req.URL))
+	wss.pipe(conn, req.ID)
+	logger.Debug("Upgraded connection closed", zap.String("id", req.ID))
+	return nil
+}
+
+// switchProtocols hijacks the caller's connection and writes a 101 response with headers.
+func switchProtocols(w http.ResponseWriter, headers http.Header) (net.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", http.StatusSwitchingProtocols, http.StatusText(http.StatusSwitchingProtocols))
+	headers.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, r: brw.Reader}, nil
+}
+
+// proxyUpgrade relays an upgrade request through the tunnel.
+func (hs *HTTPServer) proxyUpgrade(w http.ResponseWriter, r *http.Request, wss *WebSocketServer, reqMsg *HttpRequestMessage) {
+	reqMsg.Upgrade = true
+	// As in proxyTunnel, the deadline only bounds the wait for the response head.
+	ctx, cancel := context.WithTimeout(r.Context(), hs.routeTimeout(r))
+	defer cancel()
+	res, body, err := wss.Request(ctx, reqMsg, nil)
+	if err != nil {
+		writeTunnelError(w, reqMsg, err)
+		return
+	}
+	defer body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		writeResponse(w, res, body)
+		return
+	}
+
+	conn, err := switchProtocols(w, res.Headers)
+	if err != nil {
+		logger.Error("Error switching protocols", zap.String("error", err.Error()))
+		wss.streams.Reader(reqMsg.ID).Close()
+		return
+	}
+	wss.pipe(conn, reqMsg.ID)
+}
+
+// proxyUpgradeDirect performs an upgrade request itself and relays the
+// connection between the caller and the target.
+func (hs *HTTPServer) proxyUpgradeDirect(w http.ResponseWriter, req *HttpRequestMessage) {
+	resp, upstream, err := dialUpgrade(req, hs.config)
+	if err != nil {
+		logger.Error("Error in upgrade request", zap.String("url", req.URL), zap.String("error", err.Error()))
+		http.Error(w, "Failed to do request", http.StatusBadGateway)
+		return
+	}
+	if upstream == nil {
+		defer resp.Body.Close()
+		writeResponse(w, &HttpResponseMessage{StatusCode: resp.StatusCode, Headers: resp.Header}, resp.Body)
+		return
+	}
+	defer upstream.Close()
+
+	conn, err := switchProtocols(w, resp.Header)
+	if err != nil {
+		logger.Error("Error switching protocols", zap.String("error", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	<-done
+}
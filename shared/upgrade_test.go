@@ -0,0 +1,43 @@
+package shared
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+func TestDialUpgradeHandshakeDeadline(t *testing.T) {
+	// A target that accepts the connection and never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := &config.Config{ALLOW_PRIVATE_NETWORKS: true, REQUEST_TIMEOUT: time.Minute}
+	req := &HttpRequestMessage{
+		Method:   "GET",
+		URL:      "http://" + ln.Addr().String() + "/ws",
+		Headers:  map[string][]string{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+		deadline: time.Now().Add(200 * time.Millisecond),
+	}
+	start := time.Now()
+	_, _, err = dialUpgrade(req, cfg)
+	if !isTimeout(err) {
+		t.Fatalf("dialUpgrade = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dialUpgrade gave up after %v", elapsed)
+	}
+}
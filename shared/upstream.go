@@ -0,0 +1,204 @@
+package shared
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/niradler/go-netbridge/config"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const (
+	upstreamTimeout     = 30 * time.Second
+	upstreamSweepPeriod = time.Minute
+)
+
+// upstreamKey identifies a pooled upstream client.
+type upstreamKey struct {
+	addr    string
+	tls     bool
+	trusted bool
+}
+
+type upstreamClient struct {
+	*fasthttp.HostClient
+	inFlight atomic.Int64
+	requests atomic.Int64
+	errors   atomic.Int64
+	lastUsed atomic.Int64
+}
+
+// UpstreamStats reports the usage of a pooled upstream client.
+type UpstreamStats struct {
+	Addr     string    `json:"addr"`
+	TLS      bool      `json:"tls"`
+	Trusted  bool      `json:"trusted"`
+	Conns    int       `json:"conns"`
+	InFlight int64     `json:"inFlight"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// UpstreamPool keeps a long-lived fasthttp client per destination so
+// connections are reused across requests.
+type UpstreamPool struct {
+	config  *config.Config
+	mu      sync.Mutex
+	clients map[upstreamKey]*upstreamClient
+}
+
+func NewUpstreamPool(cfg *config.Config) *UpstreamPool {
+	p := &UpstreamPool{
+		config:  cfg,
+		clients: make(map[upstreamKey]*upstreamClient),
+	}
+	go p.sweeper()
+	return p
+}
+
+// client returns the pooled client for the destination of uri.
+func (p *UpstreamPool) client(uri *fasthttp.URI, requestParams *HttpRequestMessage) (*upstreamClient, error) {
+	isTLS := string(uri.Scheme()) == "https"
+	addr := string(uri.Host())
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if isTLS {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	key := upstreamKey{
+		addr:    addr,
+		tls:     isTLS,
+		trusted: requestParams.trusted,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[key]; ok {
+		return c, nil
+	}
+
+	dialer, err := dialerFor(requestParams, p.config)
+	if err != nil {
+		return nil, err
+	}
+	tlsProfiles, err := upstreamTLSFor(p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &fasthttp.HostClient{
+		Addr:                addr,
+		IsTLS:               isTLS,
+		TLSConfig:           tlsProfiles.For(addr),
+		Dial:                dialer.Dial,
+		MaxConns:            p.config.UPSTREAM_MAX_CONNS,
+		MaxConnWaitTimeout:  upstreamTimeout,
+		MaxIdleConnDuration: p.config.UPSTREAM_IDLE_TIMEOUT,
+		MaxConnDuration:     30 * time.Minute,
+		ReadBufferSize:      16 * 1024,
+		WriteBufferSize:     16 * 1024,
+		StreamResponseBody:  true,
+		// fasthttp streams chunked bodies and those with a known length above
+		// this size; bodies delimited by the connection closing are read whole,
+		// so this also caps them.
+		MaxResponseBodySize: p.config.UPSTREAM_MAX_BUFFER_SIZE,
+	}
+
+	c := &upstreamClient{HostClient: hc}
+	c.lastUsed.Store(time.Now().UnixNano())
+	p.clients[key] = c
+	GetLogger().Debug("Created upstream client", zap.String("addr", addr), zap.Bool("tls", isTLS))
+	return c, nil
+}
+
+// Do performs a single request with the pooled client for its destination.
+// The request deadline bounds the whole exchange, body included, except for
+// event streams, which stay open as long as the upstream keeps them open.
+func (p *UpstreamPool) Do(req *fasthttp.Request, resp *fasthttp.Response, requestParams *HttpRequestMessage) error {
+	c, err := p.client(req.URI(), requestParams)
+	if err != nil {
+		return err
+	}
+	if p.config.UPSTREAM_DISABLE_KEEPALIVE {
+		req.SetConnectionClose()
+	}
+
+	c.inFlight.Add(1)
+	c.requests.Add(1)
+	defer func() {
+		c.inFlight.Add(-1)
+		c.lastUsed.Store(time.Now().UnixNano())
+	}()
+	if requestParams.deadline.IsZero() || acceptsEventStream(requestParams.Headers) {
+		err = c.Do(req, resp)
+	} else {
+		err = c.DoDeadline(req, resp, requestParams.deadline)
+	}
+	if err != nil {
+		c.errors.Add(1)
+		return err
+	}
+	return nil
+}
+
+// Stats returns the usage of every pooled client, sorted by address.
+func (p *UpstreamPool) Stats() []UpstreamStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]UpstreamStats, 0, len(p.clients))
+	for key, c := range p.clients {
+		stats = append(stats, UpstreamStats{
+			Addr:     key.addr,
+			TLS:      key.tls,
+			Trusted:  key.trusted,
+			Conns:    c.ConnsCount(),
+			InFlight: c.inFlight.Load(),
+			Requests: c.requests.Load(),
+			Errors:   c.errors.Load(),
+			LastUsed: time.Unix(0, c.lastUsed.Load()),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// sweeper drops clients that have had no connections for a while, so the
+// pool does not grow with every destination ever seen.
+func (p *UpstreamPool) sweeper() {
+	ticker := time.NewTicker(upstreamSweepPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		idle := time.Now().Add(-2 * p.config.UPSTREAM_IDLE_TIMEOUT).UnixNano()
+		p.mu.Lock()
+		for key, c := range p.clients {
+			if c.inFlight.Load() == 0 && c.ConnsCount() == 0 && c.lastUsed.Load() < idle {
+				delete(p.clients, key)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+var (
+	upstreamPoolsMu sync.Mutex
+	upstreamPools   = make(map[*config.Config]*UpstreamPool)
+)
+
+// upstreamPoolFor returns the upstream pool of a config, created once.
+func upstreamPoolFor(cfg *config.Config) *UpstreamPool {
+	upstreamPoolsMu.Lock()
+	defer upstreamPoolsMu.Unlock()
+	p, ok := upstreamPools[cfg]
+	if !ok {
+		p = NewUpstreamPool(cfg)
+		upstreamPools[cfg] = p
+	}
+	return p
+}
@@ -1,11 +1,16 @@
 package shared
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/niradler/go-netbridge/config"
@@ -26,74 +31,501 @@ var upgrader = websocket.Upgrader{
 
 type WebSocketServer struct {
 	Client       *socketflow.WebSocketClient
-	responseChan chan HttpResponseMessage
+	conn         *tunnel.Conn
+	Name         string
+	Services     []string
+	RemoteAddr   string
+	ConnectedAt  time.Time
 	messageMutex sync.Mutex
 	messageWG    sync.WaitGroup
 	config       *config.Config
+	pending      *PendingRequests
+	streams      *StreamManager
+	codec        *codec // negotiated body compression, nil when off
+	framing      string // negotiated message encoding
+	peer         tunnel.Hello
+	protocol     int // tunnel protocol version spoken with the peer
+	heartbeat    heartbeat
+	draining     atomic.Bool // this side is shutting down
+	peerDraining atomic.Bool // the peer is shutting down
+	closeOnce    sync.Once
+	workers      chan struct{}
+	backlog      chan struct{} // requests taking a slot, running or queued
+	inflight     sync.Map      // request ID -> context.CancelFunc
+	cancelMu     sync.Mutex
+	earlyCancels map[string]time.Time // cancels that arrived before their request
+	active       atomic.Int64
+	queued       atomic.Int64
+	done         chan struct{}
 }
 
+func newWebSocketServer(conn *tunnel.Conn, cfg *config.Config) *WebSocketServer {
+	done := make(chan struct{})
+	client := conn.WebSocketClient
+	return &WebSocketServer{
+		Client:      client,
+		conn:        conn,
+		Name:        cfg.CLIENT_NAME,
+		ConnectedAt: time.Now(),
+		config:      cfg,
+		pending:     NewPendingRequests(),
+		streams:     NewStreamManager(conn, done, cfg.STREAM_WINDOW),
+		workers:     make(chan struct{}, cfg.MAX_CONCURRENT),
+		backlog:     make(chan struct{}, cfg.MAX_CONCURRENT+cfg.MAX_QUEUED),
+		done:        done,
+	}
+}
+
+// Close closes the connection, first telling the peer with a close frame and
+// waiting briefly for its answer.
 func (wss *WebSocketServer) Close() {
-	wss.Client.Close()
+	wss.closeOnce.Do(func() {
+		if err := wss.conn.SendClose(websocket.CloseGoingAway, "shutting down"); err == nil {
+			select {
+			case <-wss.done:
+			case <-time.After(tunnel.CloseTimeout):
+			}
+		}
+		wss.Client.Close()
+	})
 	wss.messageWG.Wait()
 }
 
+// Done is closed once the underlying WebSocket connection stops receiving messages.
+func (wss *WebSocketServer) Done() <-chan struct{} {
+	return wss.done
+}
+
 func (wss *WebSocketServer) SendMessage(msg socketflow.Message) error {
 	wss.messageMutex.Lock()
 	defer wss.messageMutex.Unlock()
-	_, err := wss.Client.SendMessage(msg.Topic, msg.Payload)
+	_, err := sendMessage(wss.conn, msg.Topic, msg.Payload)
 	return err
 }
 
-func NewWebSocketConnection(cfg *config.Config) (*WebSocketServer, error) {
-	wsURL, err := url.Parse(cfg.SOCKET_URL)
+// sendMessage sends a message to the peer, counting its payload in the metrics.
+func sendMessage(conn *tunnel.Conn, topic string, payload []byte) (string, error) {
+	id, err := conn.Send(topic, payload)
+	if err == nil {
+		metrics.tunnelSent(len(payload))
+	}
+	return id, err
+}
+
+// Request sends an HTTP request message over the tunnel and waits for the
+// response carrying the same ID. A non-nil body is sent inline when it fits in
+// a single frame and streamed otherwise. The returned body must be closed.
+func (wss *WebSocketServer) Request(ctx context.Context, req *HttpRequestMessage, body io.Reader) (*HttpResponseMessage, io.ReadCloser, error) {
+	logger := GetLogger()
+	if req.ID == "" {
+		req.ID = NewMessageID()
+	}
+	if wss.peerDraining.Load() {
+		return nil, nil, ErrTunnelDraining
+	}
+
+	if body != nil {
+		prefix, complete, err := readPrefix(body, streamFrameSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		if complete {
+			req.Body, req.Encoding = compressBody(wss.compressFor(req.Headers), prefix, wss.config.COMPRESSION_MIN_SIZE)
+			body = nil
+		} else {
+			req.Stream = true
+			body = io.MultiReader(bytes.NewReader(prefix), body)
+		}
+	}
+
+	// The peer gets the time left, not the deadline itself, so the clocks of
+	// both sides need not agree.
+	timeout := wss.config.REQUEST_TIMEOUT
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return nil, nil, ErrRequestTimeout
+	}
+	req.Timeout = timeout.Milliseconds()
+
+	responseChan := wss.pending.Add(req.ID, timeout)
+	defer wss.pending.Remove(req.ID)
+
+	payload, err := marshalPayload(wss.framing, req, &req.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse WebSocket URL: %w", err)
+		return nil, nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
-	client, err := tunnel.Connect(*wsURL, *cfg)
+
+	id, err := sendMessage(wss.conn, "request", payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to WebSocket: %w", err)
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
 	}
+	logger.Debug("Sent request", zap.String("requestID", req.ID), zap.String("messageID", id), zap.Bool("stream", req.Stream))
 
-	GetLogger().Info("WebSocket connected")
+	if req.Stream {
+		writer := wss.streams.Writer(req.ID)
+		writer.compress(wss.compressFor(req.Headers), wss.config.COMPRESSION_MIN_SIZE)
+		// Once the exchange is over the peer has either read the whole body or
+		// reset the stream, so stop sending whatever is left.
+		defer writer.abort()
+		go func() {
+			_, err := io.CopyBuffer(writer, body, make([]byte, streamFrameSize))
+			if err != nil {
+				logger.Debug("Request body stream stopped", zap.String("requestID", req.ID), zap.String("reason", err.Error()))
+				if !errors.Is(err, ErrStreamReset) && !errors.Is(err, ErrTunnelClosed) {
+					writer.CloseWithError(err)
+				}
+				return
+			}
+			writer.Close()
+		}()
+	}
 
-	server := &WebSocketServer{
-		Client:       client,
-		responseChan: make(chan HttpResponseMessage),
-		config:       cfg,
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res, ok := <-responseChan:
+		if !ok {
+			wss.sendCancel(req.ID)
+			return nil, nil, ErrRequestTimeout
+		}
+		if res.Stream {
+			return res, wss.streams.Reader(res.ID), nil
+		}
+		return res, io.NopCloser(bytes.NewReader(res.Body)), nil
+	case <-timer.C:
+		wss.sendCancel(req.ID)
+		return nil, nil, ErrRequestTimeout
+	case <-wss.done:
+		return nil, nil, ErrTunnelClosed
+	case <-ctx.Done():
+		wss.sendCancel(req.ID)
+		return nil, nil, ctx.Err()
 	}
+}
+
+// listen starts receiving messages and serves requests and responses until the connection drops.
+func (wss *WebSocketServer) listen() {
+	logger := GetLogger()
+	client := wss.Client
+
+	requests := client.Subscribe("request")
+	responses := client.Subscribe("response")
+	frames := client.Subscribe("stream")
+	acks := client.Subscribe("stream-ack")
+	cancels := client.Subscribe("cancel")
+	pings := client.Subscribe("ping")
+	pongs := client.Subscribe("pong")
+	drains := client.Subscribe("drain")
+
+	go func() {
+		client.ReceiveMessages()
+		close(wss.done)
+		for _, topic := range []string{"request", "response", "stream", "stream-ack", "cancel", "ping", "pong", "drain"} {
+			client.Unsubscribe(topic)
+		}
+	}()
+
+	wss.pending.StartSweeper(wss.config.REQUEST_TIMEOUT, wss.done)
+	wss.streams.StartSweeper(wss.config.REQUEST_TIMEOUT)
+	wss.startHeartbeat()
+
+	go func() {
+		for msg := range responses {
+			metrics.tunnelReceived(len(msg.Payload))
+			var res HttpResponseMessage
+			if err := unmarshalPayload(msg.Payload, &res, &res.Body); err != nil {
+				logger.Error("Error parsing response message", zap.String("error", err.Error()))
+				continue
+			}
+			if body, err := decodeBody(res.Body, res.Encoding); err != nil {
+				logger.Error("Error decoding response body", zap.String("requestID", res.ID), zap.String("error", err.Error()))
+				res = HttpResponseMessage{ID: res.ID, StatusCode: http.StatusBadGateway, Headers: map[string][]string{}, Body: []byte(err.Error())}
+			} else {
+				res.Body, res.Encoding = body, ""
+			}
+			if !wss.pending.Resolve(&res) {
+				logger.Warn("Dropping response with no pending request", zap.String("requestID", res.ID))
+			}
+		}
+	}()
+
+	go func() {
+		for msg := range frames {
+			metrics.tunnelReceived(len(msg.Payload))
+			var frame StreamFrame
+			if err := unmarshalPayload(msg.Payload, &frame, &frame.Data); err != nil {
+				logger.Error("Error parsing stream frame", zap.String("error", err.Error()))
+				continue
+			}
+			wss.streams.HandleFrame(&frame)
+		}
+	}()
+
+	go func() {
+		for msg := range acks {
+			metrics.tunnelReceived(len(msg.Payload))
+			var ack StreamAck
+			if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+				logger.Error("Error parsing stream ack", zap.String("error", err.Error()))
+				continue
+			}
+			wss.streams.HandleAck(&ack)
+		}
+	}()
+
+	go func() {
+		for msg := range cancels {
+			metrics.tunnelReceived(len(msg.Payload))
+			var cancel CancelMessage
+			if err := json.Unmarshal(msg.Payload, &cancel); err != nil {
+				logger.Error("Error parsing cancel message", zap.String("error", err.Error()))
+				continue
+			}
+			wss.handleCancel(&cancel)
+		}
+	}()
 
-	server.messageWG.Add(1)
-	go client.ReceiveMessages()
+	go func() {
+		for msg := range pings {
+			metrics.tunnelReceived(len(msg.Payload))
+			var hb Heartbeat
+			if err := json.Unmarshal(msg.Payload, &hb); err != nil {
+				logger.Error("Error parsing heartbeat", zap.String("error", err.Error()))
+				continue
+			}
+			wss.handlePing(&hb)
+		}
+	}()
 
 	go func() {
-		for msg := range client.Subscribe("request") {
+		for msg := range pongs {
+			metrics.tunnelReceived(len(msg.Payload))
+			var hb Heartbeat
+			if err := json.Unmarshal(msg.Payload, &hb); err != nil {
+				logger.Error("Error parsing heartbeat", zap.String("error", err.Error()))
+				continue
+			}
+			wss.handlePong(&hb)
+		}
+	}()
+
+	go func() {
+		for msg := range drains {
+			metrics.tunnelReceived(len(msg.Payload))
+			wss.handleDrain()
+		}
+	}()
+
+	go func() {
+		for msg := range requests {
+			metrics.tunnelReceived(len(msg.Payload))
+			logger.Debug("Received message", zap.String("id", msg.ID))
 			var req HttpRequestMessage
-			if err := json.Unmarshal(msg.Payload, &req); err != nil {
-				GetLogger().Error("Error parsing request message", zap.String("error", err.Error()))
-				SendResponseMessage(HttpResponseMessage{
-					StatusCode: http.StatusBadRequest,
-					Headers:    map[string][]string{},
-					Body:       []byte(err.Error()),
-				}, client)
+			if err := unmarshalPayload(msg.Payload, &req, &req.Body); err != nil {
+				logger.Error("Error parsing request message", zap.String("error", err.Error()))
 				continue
 			}
-			if err := HttpRequestResponse(&req, cfg, client); err != nil {
-				GetLogger().Error("Error in HTTP request", zap.String("error", err.Error()))
-				SendResponseMessage(HttpResponseMessage{
-					StatusCode: http.StatusBadRequest,
-					Headers:    map[string][]string{},
-					Body:       []byte(err.Error()),
-				}, client)
+			// Requests run concurrently so a slow upstream or a streamed body
+			// never holds up the rest; the read loop itself must never block.
+			if !wss.admit(&req) {
+				go wss.rejectRequest(&req)
+				continue
 			}
+			go wss.handleRequest(&req)
 		}
 	}()
 
 	statusChan := client.SubscribeToStatus()
 	go func() {
-		for status := range statusChan {
-			GetLogger().Debug("Received status", zap.Any("status", status))
+		for {
+			select {
+			case status := <-statusChan:
+				if status.Error == nil {
+					logger.Debug("Received status", zap.String("type", status.Type), zap.String("message", status.Message))
+					continue
+				}
+				if websocket.IsCloseError(status.Error, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					logger.Info("Tunnel connection closed", zap.String("client", wss.Name), zap.String("reason", status.Error.Error()))
+					continue
+				}
+				logger.Warn("Tunnel connection error", zap.String("client", wss.Name), zap.String("message", status.Message), zap.String("error", status.Error.Error()), zap.Duration("lastRTT", wss.RTT()))
+			case <-wss.done:
+				wss.drainStatus(statusChan)
+				return
+			}
 		}
 	}()
+}
+
+// drainStatus keeps emptying the status channel once the connection is gone.
+// Every failed send reports to it, and socketflow blocks sends while it is
+// full, so without this requests still finishing would hang on their reply.
+// Nothing sends once the last request ran out of time.
+func (wss *WebSocketServer) drainStatus(statusChan <-chan socketflow.Status) {
+	idle := time.NewTimer(wss.config.REQUEST_TIMEOUT)
+	defer idle.Stop()
+	for {
+		select {
+		case <-statusChan:
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(wss.config.REQUEST_TIMEOUT)
+		case <-idle.C:
+			return
+		}
+	}
+}
+
+// acquireWorker waits for one of the MAX_CONCURRENT request slots, at most
+// until the request's deadline or until it is cancelled.
+func (wss *WebSocketServer) acquireWorker(req *HttpRequestMessage) error {
+	wss.queued.Add(1)
+	defer wss.queued.Add(-1)
+	timer := time.NewTimer(time.Until(req.deadline))
+	defer timer.Stop()
+	select {
+	case wss.workers <- struct{}{}:
+		wss.active.Add(1)
+		return nil
+	case <-timer.C:
+		return ErrRequestTimeout
+	case <-req.cancel:
+		return ErrRequestCancelled
+	case <-wss.done:
+		return ErrTunnelClosed
+	}
+}
 
-	return server, nil
+func (wss *WebSocketServer) releaseWorker() {
+	wss.active.Add(-1)
+	<-wss.workers
+}
+
+// takesSlot reports whether req waits for one of the MAX_CONCURRENT slots.
+// TCP connections and upgraded streams are long lived relays and do not.
+func (req *HttpRequestMessage) takesSlot() bool {
+	return req.Method != http.MethodConnect && !req.Upgrade
+}
+
+// admit reserves room for req among the requests running or queued, of which
+// there are at most MAX_CONCURRENT plus MAX_QUEUED. handleRequest releases it.
+func (wss *WebSocketServer) admit(req *HttpRequestMessage) bool {
+	if !req.takesSlot() {
+		return true
+	}
+	select {
+	case wss.backlog <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// rejectRequest answers a request that found the queue full.
+func (wss *WebSocketServer) rejectRequest(req *HttpRequestMessage) {
+	GetLogger().Warn("Request queue is full, rejecting request", zap.String("client", wss.Name), zap.String("requestID", req.ID), zap.Int("maxQueued", wss.config.MAX_QUEUED))
+	SendResponseMessage(HttpResponseMessage{
+		ID:         req.ID,
+		StatusCode: http.StatusServiceUnavailable,
+		Headers:    map[string][]string{},
+		Body:       []byte("request queue is full"),
+	}, wss)
+}
+
+func (wss *WebSocketServer) handleRequest(req *HttpRequestMessage) {
+	if req.takesSlot() {
+		defer func() { <-wss.backlog }()
+	}
+	if wss.draining.Load() {
+		// Sent before the peer learned this side is shutting down.
+		SendResponseMessage(HttpResponseMessage{
+			ID:         req.ID,
+			StatusCode: http.StatusServiceUnavailable,
+			Headers:    map[string][]string{},
+			Body:       []byte(ErrTunnelDraining.Error()),
+		}, wss)
+		return
+	}
+	body, err := decodeBody(req.Body, req.Encoding)
+	if err != nil {
+		SendResponseMessage(HttpResponseMessage{
+			ID:         req.ID,
+			StatusCode: http.StatusBadRequest,
+			Headers:    map[string][]string{},
+			Body:       []byte(err.Error()),
+		}, wss)
+		return
+	}
+	req.Body, req.Encoding = body, ""
+
+	if req.Service != "" {
+		if err := resolveService(req, wss.config); err != nil {
+			SendResponseMessage(HttpResponseMessage{
+				ID:         req.ID,
+				StatusCode: http.StatusNotFound,
+				Headers:    map[string][]string{},
+				Body:       []byte(err.Error()),
+			}, wss)
+			return
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		wss.handleConnect(req)
+		return
+	}
+	if req.Upgrade {
+		err = wss.handleUpgrade(req)
+	} else {
+		req.receiveDeadline(wss.config.REQUEST_TIMEOUT)
+		done := wss.track(req)
+		defer done()
+
+		traceParent := req.Trace
+		if traceParent == "" {
+			traceParent = http.Header(req.Headers).Get("traceparent")
+		}
+		req.span = tracerFor(wss.config).Start("handle "+req.Method, spanKindServer, nil, traceParent)
+		req.span.SetAttribute("netbridge.request_id", req.ID)
+		defer func() {
+			req.span.Fail(err)
+			req.span.End()
+		}()
+
+		queue := req.span.Child("queue", spanKindInternal)
+		err = wss.acquireWorker(req)
+		queue.End()
+		if errors.Is(err, ErrTunnelClosed) {
+			return
+		}
+		if err == nil {
+			err = HttpRequestResponse(req, wss.config, wss)
+			wss.releaseWorker()
+		}
+	}
+	if errors.Is(err, ErrRequestCancelled) {
+		// Nobody is waiting for a response any more.
+		GetLogger().Debug("Request cancelled", zap.String("requestID", req.ID))
+		return
+	}
+	if err != nil {
+		GetLogger().Error("Error in HTTP request", zap.String("error", err.Error()))
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, ErrRequestNotAllowed), errors.Is(err, ErrBlockedAddress):
+			status = http.StatusForbidden
+		case isTimeout(err):
+			status = http.StatusGatewayTimeout
+		}
+		SendResponseMessage(HttpResponseMessage{
+			ID:         req.ID,
+			StatusCode: status,
+			Headers:    map[string][]string{},
+			Body:       []byte(err.Error()),
+		}, wss)
+	}
 }
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the version of the tunnel message format. It is bumped
+// whenever a change would make an older peer misread messages;
+// MinProtocolVersion is the oldest one this build still speaks.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// HelloHeader carries a side's Hello on the handshake: the client's on the
+// request, the server's on the response.
+const HelloHeader = "X-Tunnel-Hello"
+
+// Features a side may support.
+const (
+	FeatureStreaming   = "streaming"
+	FeatureCompression = "compression"
+	FeatureTCP         = "tcp"
+	FeatureHeartbeat   = "heartbeat"
+	FeatureDrain       = "drain"
+)
+
+// requiredFeatures are features this build cannot work without.
+var requiredFeatures = []string{FeatureStreaming}
+
+// Version is the build version, set with
+// -ldflags "-X github.com/niradler/go-netbridge/tunnel.Version=v1.2.3".
+// Without it the VCS revision is used.
+var Version = ""
+
+func init() {
+	if Version != "" {
+		return
+	}
+	Version = "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				Version = setting.Value[:12]
+			}
+		}
+	}
+}
+
+// Hello describes what a side of the tunnel speaks.
+type Hello struct {
+	Protocol    int
+	MinProtocol int
+	Version     string
+	Features    []string
+}
+
+// legacyHello stands for peers from before the hello exchange, which spoke
+// protocol 1 without any of its features.
+var legacyHello = Hello{
+	Protocol:    1,
+	MinProtocol: 1,
+	Version:     "unknown",
+}
+
+// NewHello returns the Hello of this build with the given features enabled.
+func NewHello(features ...string) Hello {
+	return Hello{
+		Protocol:    ProtocolVersion,
+		MinProtocol: MinProtocolVersion,
+		Version:     Version,
+		Features:    features,
+	}
+}
+
+// String encodes h for HelloHeader, e.g.
+// "protocol=1; min=1; version=v1.2.3; features=streaming,tcp".
+func (h Hello) String() string {
+	return fmt.Sprintf("protocol=%d; min=%d; version=%s; features=%s", h.Protocol, h.MinProtocol, h.Version, strings.Join(h.Features, ","))
+}
+
+// ParseHello decodes a HelloHeader value. An empty value comes from a peer
+// that predates the hello exchange.
+func ParseHello(value string) (Hello, error) {
+	if strings.TrimSpace(value) == "" {
+		return legacyHello, nil
+	}
+	var h Hello
+	for _, field := range strings.Split(value, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch key {
+		case "protocol":
+			h.Protocol, err = strconv.Atoi(val)
+		case "min":
+			h.MinProtocol, err = strconv.Atoi(val)
+		case "version":
+			h.Version = val
+		case "features":
+			for _, feature := range strings.Split(val, ",") {
+				if feature = strings.TrimSpace(feature); feature != "" {
+					h.Features = append(h.Features, feature)
+				}
+			}
+		}
+		if err != nil {
+			return Hello{}, fmt.Errorf("invalid tunnel hello %q: %w", value, err)
+		}
+	}
+	if h.Protocol <= 0 {
+		return Hello{}, fmt.Errorf("invalid tunnel hello %q: no protocol version", value)
+	}
+	if h.MinProtocol <= 0 || h.MinProtocol > h.Protocol {
+		h.MinProtocol = h.Protocol
+	}
+	return h, nil
+}
+
+func (h Hello) Has(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the protocol version to speak with a peer that sent
+// peer, or an error explaining why the two builds cannot talk.
+func Negotiate(peer Hello) (int, error) {
+	if peer.Protocol < MinProtocolVersion {
+		return 0, fmt.Errorf("peer %s speaks tunnel protocol %d, but build %s needs at least %d", peer.Version, peer.Protocol, Version, MinProtocolVersion)
+	}
+	if peer.MinProtocol > ProtocolVersion {
+		return 0, fmt.Errorf("peer %s needs tunnel protocol %d or later, but build %s speaks at most %d", peer.Version, peer.MinProtocol, Version, ProtocolVersion)
+	}
+	for _, feature := range requiredFeatures {
+		if !peer.Has(feature) {
+			return 0, fmt.Errorf("peer %s does not support %s, which build %s requires", peer.Version, feature, Version)
+		}
+	}
+	return min(peer.Protocol, ProtocolVersion), nil
+}
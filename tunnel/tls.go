@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/niradler/go-netbridge/config"
+)
+
+// LoadCertPool reads PEM encoded CA certificates from file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// clientTLSConfig returns the TLS settings for dialing the tunnel server: the
+// client certificate for mutual TLS and the CA the server certificate is
+// verified against, when configured.
+func clientTLSConfig(config config.Config) (*tls.Config, error) {
+	if config.TLS_CERT_FILE == "" && config.SOCKET_CA_FILE == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLS_CERT_FILE != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS_CERT_FILE, config.TLS_KEY_FILE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.SOCKET_CA_FILE != "" {
+		pool, err := LoadCertPool(config.SOCKET_CA_FILE)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
@@ -1,9 +1,16 @@
 package tunnel
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,6 +20,23 @@ import (
 
 const maxMessageSize = 6 * 1024 * 1024 // 6 MB in bytes
 
+// chunkSize is large enough for a body stream frame to travel as one message.
+const chunkSize = 64 * 1024
+
+// ClientNameHeader carries the client identity on the WebSocket handshake.
+const ClientNameHeader = "X-Client-Name"
+
+// PublishHeader lists the services a client publishes through the server.
+const PublishHeader = "X-Publish"
+
+// CompressionHeader carries the body codecs a client accepts on the
+// handshake, and the one the server picked in the response.
+const CompressionHeader = "X-Tunnel-Compression"
+
+// FramingHeader carries the message encodings a client accepts on the
+// handshake, and the one the server picked in the response.
+const FramingHeader = "X-Tunnel-Framing"
+
 var Upgrader = websocket.Upgrader{
 	ReadBufferSize:  maxMessageSize,
 	WriteBufferSize: maxMessageSize,
@@ -21,41 +45,131 @@ var Upgrader = websocket.Upgrader{
 	},
 }
 
-func Create(w http.ResponseWriter, r *http.Request) (*socketflow.WebSocketClient, error) {
-	conn, err := Upgrader.Upgrade(w, r, nil)
+// CloseTimeout bounds writing a close frame and waiting for the peer's answer.
+const CloseTimeout = time.Second
+
+// Conn is a tunnel connection. Messages go through the embedded socketflow
+// client, or are written as binary frames by Send once UseBinaryFrames is
+// set; the WebSocket itself is kept to close the connection properly.
+type Conn struct {
+	*socketflow.WebSocketClient
+	ws     *websocket.Conn
+	mu     sync.Mutex // serializes Send
+	binary socketflow.Serializer
+}
+
+func newConn(ws *websocket.Conn) *Conn {
+	return &Conn{
+		WebSocketClient: socketflow.NewWebSocketClient(ws, socketflow.Config{
+			ChunkSize:        chunkSize,
+			RetryConfig:      retryConfig,
+			ReassembleChunks: true,
+		}),
+		ws: ws,
+	}
+}
+
+// UseBinaryFrames makes Send encode messages with s and write each as a single
+// binary frame. socketflow writes unchunked messages as text frames, which
+// must be valid UTF-8. s also decodes the messages received.
+func (c *Conn) UseBinaryFrames(s socketflow.Serializer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SetSerializer(s)
+	c.binary = s
+}
+
+// Send sends payload on topic and returns the message ID. All messages must
+// be sent with it, as the WebSocket allows a single writer at a time.
+func (c *Conn) Send(topic string, payload []byte) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.binary == nil {
+		return c.SendMessage(topic, payload)
+	}
+	id := messageID()
+	data, err := c.binary.Marshal(&socketflow.Message{ID: id, Topic: topic, Payload: payload})
+	if err != nil {
+		return id, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return id, c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func messageID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Failed to generate message ID: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// SendClose starts the closing handshake with a close frame. The peer answers
+// with its own, which ends the read loop; Close then tears the socket down.
+func (c *Conn) SendClose(code int, reason string) error {
+	return c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(CloseTimeout))
+}
+
+func Create(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+	conn, err := Upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Println("Error upgrading connection:", err)
 		return nil, err
 	}
-	client := socketflow.NewWebSocketClient(conn, socketflow.Config{
-		ChunkSize:        1024,
-		ReassembleChunks: true,
-	})
-	return client, nil
+	return newConn(conn), nil
+}
+
+// retryConfig disables socketflow write retries: a failed write means the
+// connection is gone and the client reconnects instead.
+var retryConfig = socketflow.RetryConfig{
+	MaxRetries:      1,
+	InitialDelay:    100 * time.Millisecond,
+	MaxDelay:        100 * time.Millisecond,
+	ExponentialBase: 1,
 }
 
-func Connect(url url.URL, config config.Config) (*socketflow.WebSocketClient, error) {
+// Connect dials the tunnel server once, introducing this side with hello, and
+// returns the connection along with the handshake response headers.
+// Reconnecting is left to the caller.
+func Connect(url url.URL, config config.Config, hello Hello) (*Conn, http.Header, error) {
 	headers := http.Header{}
+	headers.Set(HelloHeader, hello.String())
 	if config.SECRET != "" && config.Type == "client" {
-		headers.Add("Authorization", config.SECRET)
+		headers.Set("Authorization", "Bearer "+config.SECRET)
+	}
+	// With a client certificate the server takes the name from it.
+	if config.CLIENT_NAME != "" && config.TLS_CERT_FILE == "" {
+		headers.Set(ClientNameHeader, config.CLIENT_NAME)
+	}
+	if len(config.PUBLISH) > 0 {
+		services := make([]string, 0, len(config.PUBLISH))
+		for name := range config.PUBLISH {
+			services = append(services, name)
+		}
+		sort.Strings(services)
+		headers.Set(PublishHeader, strings.Join(services, ","))
+	}
+	if len(config.COMPRESSION) > 0 {
+		headers.Set(CompressionHeader, strings.Join(config.COMPRESSION, ","))
+	}
+	if len(config.FRAMING) > 0 {
+		headers.Set(FramingHeader, strings.Join(config.FRAMING, ","))
 	}
 
-	var client *socketflow.WebSocketClient
-	var err error
-	maxRetries := 3
+	tlsConfig, err := clientTLSConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
 
-	for i := 0; i < maxRetries; i++ {
-		conn, _, err := websocket.DefaultDialer.Dial(url.String(), headers)
-		if err == nil {
-			client = socketflow.NewWebSocketClient(conn, socketflow.Config{
-				ChunkSize:        1024, //TODO: chunk should be bigger
-				ReassembleChunks: true, // TODO: use chunk to stream body instead
-			})
-			return client, nil
+	conn, resp, err := dialer.Dial(url.String(), headers)
+	if err != nil {
+		if resp != nil {
+			reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("handshake rejected with %s: %s", resp.Status, strings.TrimSpace(string(reason)))
 		}
-		time.Sleep(1 * time.Second)
-		log.Printf("Failed to connect to WebSocket server (attempt %d/%d): %v", i+1, maxRetries, err)
+		return nil, nil, err
 	}
-
-	return nil, err
+	return newConn(conn), resp.Header, nil
 }